@@ -1,276 +1,205 @@
 package run
 
 /*
- * This file contains the "backend" functionality for the CLI commands (and flags)
+ * This file contains the CLI commands (and flags), which translate the user's input for the cluster package
  */
 
 import (
-	"bytes"
 	"context"
-	"errors"
 	"fmt"
-	"log"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
+	units "github.com/docker/go-units"
+	"github.com/olekukonko/tablewriter"
+	"github.com/rancher/k3d/cluster"
+	"github.com/rancher/k3d/runtimes"
+	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
-const (
-	defaultRegistry    = "docker.io"
-	defaultServerCount = 1
-)
-
 // CheckTools checks if the docker API server is responding
 func CheckTools(c *cli.Context) error {
-	log.Print("Checking docker...")
-	ctx := context.Background()
-	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	log.Info("Checking docker...")
+	ctx := getContext(c)
+	rt, err := getRuntime(c)
 	if err != nil {
 		return err
 	}
-	ping, err := docker.Ping(ctx)
+	ping, err := rt.Ping(ctx)
 
 	if err != nil {
-		return fmt.Errorf("ERROR: checking docker failed\n%+v", err)
+		return &cluster.Error{Kind: cluster.ErrRuntimeUnavailable, Message: "checking docker failed", Err: err}
 	}
-	log.Printf("SUCCESS: Checking docker succeeded (API: v%s)\n", ping.APIVersion)
+	log.Infof("Checking docker succeeded (API: v%s)", ping.APIVersion)
 	return nil
 }
 
-// CreateCluster creates a new single-node cluster container and initializes the cluster directory
-func CreateCluster(c *cli.Context) error {
-
-	if err := CheckClusterName(c.String("name")); err != nil {
-		return err
-	}
-
-	if cluster, err := getClusters(false, c.String("name")); err != nil {
-		return err
-	} else if len(cluster) != 0 {
-		// A cluster exists with the same name. Return with an error.
-		return fmt.Errorf("ERROR: Cluster %s already exists", c.String("name"))
-	}
-
-	// On Error delete the cluster.  If there createCluster() encounter any error,
-	// call this function to remove all resources allocated for the cluster so far
-	// so that they don't linger around.
-	deleteCluster := func() {
-		if err := DeleteCluster(c); err != nil {
-			log.Printf("Error: Failed to delete cluster %s", c.String("name"))
-		}
-	}
+// getClusterSpec translates the flags of the create and run commands into a cluster spec
+func getClusterSpec(c *cli.Context) (cluster.Spec, error) {
 
 	// define image
 	image := c.String("image")
 	if c.IsSet("version") {
 		// TODO: --version to be deprecated
-		log.Println("[WARNING] The `--version` flag will be deprecated soon, please use `--image rancher/k3s:<version>` instead")
+		log.Warn("The `--version` flag will be deprecated soon, please use `--image rancher/k3s:<version>` instead")
 		if c.IsSet("image") {
 			// version specified, custom image = error (to push deprecation of version flag)
-			log.Fatalln("[ERROR] Please use `--image <image>:<version>` instead of --image and --version")
-		} else {
-			// version specified, default image = ok (until deprecation of version flag)
-			image = fmt.Sprintf("%s:%s", strings.Split(image, ":")[0], c.String("version"))
+			return cluster.Spec{}, fmt.Errorf("Please use `--image <image>:<version>` instead of --image and --version")
 		}
+		// version specified, default image = ok (until deprecation of version flag)
+		image = fmt.Sprintf("%s:%s", strings.Split(image, ":")[0], c.String("version"))
 	}
-	if len(strings.Split(image, "/")) <= 2 {
-		// fallback to default registry
-		image = fmt.Sprintf("%s/%s", defaultRegistry, image)
+
+	// TODO: --port will soon be --api-port since we want to re-use --port for arbitrary port mappings
+	if c.IsSet("port") {
+		log.Info("As of v2.0.0 --port will be used for arbitrary port mapping. Please use --api-port/-a instead for configuring the Api Port")
 	}
 
-	// create cluster network
-	networkID, err := createClusterNetwork(c.String("name"))
+	pools := []cluster.Pool{}
+	for _, poolSpec := range c.StringSlice("pool") {
+		pool, err := parsePool(poolSpec)
+		if err != nil {
+			return cluster.Spec{}, err
+		}
+		pools = append(pools, pool)
+	}
+
+	return cluster.Spec{
+		Name:            c.String("name"),
+		Image:           image,
+		APIPort:         c.String("api-port"),
+		Workers:         c.Int("workers"),
+		Volumes:         c.StringSlice("volume"),
+		Publish:         c.StringSlice("publish"),
+		PortAutoOffset:  c.Int("port-auto-offset"),
+		ServerArgs:      c.StringSlice("server-arg"),
+		AgentArgs:       c.StringSlice("agent-arg"),
+		Env:             c.StringSlice("env"),
+		NodeLabels:      c.StringSlice("node-label"),
+		NodeTaints:      c.StringSlice("node-taint"),
+		Memory:          c.StringSlice("memory"),
+		CPUs:            c.StringSlice("cpus"),
+		PidsLimit:       c.StringSlice("pids-limit"),
+		Pools:           pools,
+		AutoRestart:     c.Bool("auto-restart"),
+		ImportImages:    c.StringSlice("import-image"),
+		Network:         c.String("network"),
+		Subnet:          c.String("subnet"),
+		Gateway:         c.String("gateway"),
+		IPRange:         c.String("ip-range"),
+		IPs:             c.StringSlice("ip"),
+		IPv6:            c.Bool("ipv6"),
+		DualStack:       c.Bool("dual-stack"),
+		NetworkInternal: c.Bool("network-internal"),
+		ImageCache:      c.Bool("image-cache"),
+		Wait:            c.IsSet("wait"),
+		Timeout:         time.Duration(c.Int("wait")) * time.Second,
+		Verbose:         c.GlobalBool("verbose"),
+	}, nil
+}
+
+// CreateCluster creates a new single-node cluster container and initializes the cluster directory
+func CreateCluster(c *cli.Context) error {
+	spec, err := getClusterSpec(c)
 	if err != nil {
 		return err
 	}
-	log.Printf("Created cluster network with ID %s", networkID)
-
-	// environment variables
-	env := []string{"K3S_KUBECONFIG_OUTPUT=/output/kubeconfig.yaml"}
-	env = append(env, c.StringSlice("env")...)
-	env = append(env, fmt.Sprintf("K3S_CLUSTER_SECRET=%s", GenerateRandomString(20)))
 
-	// k3s server arguments
-	// TODO: --port will soon be --api-port since we want to re-use --port for arbitrary port mappings
-	if c.IsSet("port") {
-		log.Println("INFO: As of v2.0.0 --port will be used for arbitrary port mapping. Please use --api-port/-a instead for configuring the Api Port")
-	}
-	apiPort, err := parseAPIPort(c.String("api-port"))
+	rt, err := getRuntime(c)
 	if err != nil {
 		return err
 	}
-
-	k3AgentArgs := []string{}
-	k3sServerArgs := []string{"--https-listen-port", apiPort.Port}
-
-	// When the 'host' is not provided by --api-port, try to fill it using Docker Machine's IP address.
-	if apiPort.Host == "" {
-		apiPort.Host, err = getDockerMachineIp()
-		// IP address is the same as the host
-		apiPort.HostIP = apiPort.Host
-		// In case of error, Log a warning message, and continue on. Since it more likely caused by a miss configured
-		// DOCKER_MACHINE_NAME environment variable.
-		if err != nil {
-			log.Printf("WARNING: Failed to get docker machine IP address, ignoring the DOCKER_MACHINE_NAME environment variable setting.\n")
-		}
+	if _, err := cluster.Create(getContext(c), rt, spec); err != nil {
+		return flagError(err)
 	}
 
-	if apiPort.Host != "" {
-		// Add TLS SAN for non default host name
-		log.Printf("Add TLS SAN for %s", apiPort.Host)
-		k3sServerArgs = append(k3sServerArgs, "--tls-san", apiPort.Host)
-	}
+	log.Infof(`You can now use the cluster with:
 
-	if c.IsSet("server-arg") || c.IsSet("x") {
-		k3sServerArgs = append(k3sServerArgs, c.StringSlice("server-arg")...)
-	}
+export KUBECONFIG="$(%s get-kubeconfig --name='%s')"
+kubectl cluster-info`, os.Args[0], spec.Name)
 
-	if c.IsSet("agent-arg") {
-		k3AgentArgs = append(k3AgentArgs, c.StringSlice("agent-arg")...)
-	}
+	return nil
+}
 
-	// new port map
-	portmap, err := mapNodesToPortSpecs(c.StringSlice("publish"), GetAllContainerNames(c.String("name"), defaultServerCount, c.Int("workers")))
-	if err != nil {
-		log.Fatal(err)
+// RunCluster creates a temporary cluster, runs the command given after -- against it and deletes the cluster again.
+// It exits with the exit code of the command.
+func RunCluster(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return fmt.Errorf("no command specified, use `%s run [flags] -- COMMAND [ARG...]`", os.Args[0])
 	}
 
-	// create a docker volume for sharing image tarballs with the cluster
-	imageVolume, err := createImageVolume(c.String("name"))
-	log.Println("Created docker volume ", imageVolume.Name)
+	spec, err := getClusterSpec(c)
 	if err != nil {
 		return err
 	}
-	volumes := c.StringSlice("volume")
-	volumes = append(volumes, fmt.Sprintf("%s:/images", imageVolume.Name))
-
-	clusterSpec := &ClusterSpec{
-		AgentArgs:         k3AgentArgs,
-		APIPort:           *apiPort,
-		AutoRestart:       c.Bool("auto-restart"),
-		ClusterName:       c.String("name"),
-		Env:               env,
-		Image:             image,
-		NodeToPortSpecMap: portmap,
-		PortAutoOffset:    c.Int("port-auto-offset"),
-		ServerArgs:        k3sServerArgs,
-		Verbose:           c.GlobalBool("verbose"),
-		Volumes:           volumes,
+	if spec.Name == "" {
+		spec.Name = fmt.Sprintf("run-%s", strings.ToLower(cluster.GenerateRandomString(8)))
 	}
+	// don't collide with other clusters, e.g. of parallel CI jobs, on the default API port
+	if !c.IsSet("api-port") {
+		if spec.APIPort, err = cluster.FreePort(); err != nil {
+			return err
+		}
+	}
+	// the command can only run once the cluster is up, --wait sets the timeout
+	spec.Wait = true
 
-	// create the server
-	log.Printf("Creating cluster [%s]", c.String("name"))
-
-	// create the directory where we will put the kubeconfig file by default (when running `k3d get-config`)
-	createClusterDir(c.String("name"))
-
-	dockerID, err := createServer(clusterSpec)
+	rt, err := getRuntime(c)
 	if err != nil {
-		deleteCluster()
 		return err
 	}
 
-	ctx := context.Background()
-	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	exitCode, err := runCommand(getContext(c), rt, spec, c.Args(), c.Bool("keep-on-failure"))
 	if err != nil {
 		return err
 	}
-
-	// Wait for k3s to be up and running if wanted.
-	// We're simply scanning the container logs for a line that tells us that everything's up and running
-	// TODO: also wait for worker nodes
-	start := time.Now()
-	timeout := time.Duration(c.Int("wait")) * time.Second
-	for c.IsSet("wait") {
-		// not running after timeout exceeded? Rollback and delete everything.
-		if timeout != 0 && time.Now().After(start.Add(timeout)) {
-			deleteCluster()
-			return errors.New("Cluster creation exceeded specified timeout")
-		}
-
-		// scan container logs for a line that tells us that the required services are up and running
-		out, err := docker.ContainerLogs(ctx, dockerID, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
-		if err != nil {
-			out.Close()
-			return fmt.Errorf("ERROR: couldn't get docker logs for %s\n%+v", c.String("name"), err)
-		}
-		buf := new(bytes.Buffer)
-		nRead, _ := buf.ReadFrom(out)
-		out.Close()
-		output := buf.String()
-		if nRead > 0 && strings.Contains(string(output), "Running kubelet") {
-			break
-		}
-
-		time.Sleep(1 * time.Second)
+	if exitCode != 0 {
+		return cli.NewExitError("", exitCode)
 	}
+	return nil
+}
 
-	// spin up the worker nodes
-	// TODO: do this concurrently in different goroutines
-	if c.Int("workers") > 0 {
-		log.Printf("Booting %s workers for cluster %s", strconv.Itoa(c.Int("workers")), c.String("name"))
-		for i := 0; i < c.Int("workers"); i++ {
-			workerID, err := createWorker(clusterSpec, i)
-			if err != nil {
-				deleteCluster()
-				return err
-			}
-			log.Printf("Created worker with ID %s\n", workerID)
-		}
+// getClusterNames returns the names of all clusters if --all is set or the one selected with --name
+func getClusterNames(ctx context.Context, rt runtimes.Runtime, c *cli.Context) ([]string, error) {
+	if !c.Bool("all") {
+		return []string{c.String("name")}, nil
 	}
-
-	log.Printf("SUCCESS: created cluster [%s]", c.String("name"))
-	log.Printf(`You can now use the cluster with:
-
-export KUBECONFIG="$(%s get-kubeconfig --name='%s')"
-kubectl cluster-info`, os.Args[0], c.String("name"))
-
-	return nil
+	clusters, err := cluster.List(ctx, rt)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, cl := range clusters {
+		names = append(names, cl.Name)
+	}
+	return names, nil
 }
 
 // DeleteCluster removes the containers belonging to a cluster and its local directory
 func DeleteCluster(c *cli.Context) error {
-	clusters, err := getClusters(c.Bool("all"), c.String("name"))
-
+	ctx := getContext(c)
+	rt, err := getRuntime(c)
+	if err != nil {
+		return err
+	}
+	names, err := getClusterNames(ctx, rt, c)
 	if err != nil {
 		return err
 	}
 
 	// remove clusters one by one instead of appending all names to the docker command
 	// this allows for more granular error handling and logging
-	for _, cluster := range clusters {
-		log.Printf("Removing cluster [%s]", cluster.name)
-		if len(cluster.workers) > 0 {
-			// TODO: this could be done in goroutines
-			log.Printf("...Removing %d workers\n", len(cluster.workers))
-			for _, worker := range cluster.workers {
-				if err := removeContainer(worker.ID); err != nil {
-					log.Println(err)
-					continue
-				}
-			}
-		}
-		deleteClusterDir(cluster.name)
-		log.Println("...Removing server")
-		if err := removeContainer(cluster.server.ID); err != nil {
-			return fmt.Errorf("ERROR: Couldn't remove server for cluster %s\n%+v", cluster.name, err)
-		}
-
-		if err := deleteClusterNetwork(cluster.name); err != nil {
-			log.Printf("WARNING: couldn't delete cluster network for cluster %s\n%+v", cluster.name, err)
+	for _, name := range names {
+		if err := cluster.Delete(ctx, rt, name); err != nil {
+			return err
 		}
-
-		log.Println("...Removing docker image volume")
-		if err := deleteImageVolume(cluster.name); err != nil {
-			log.Printf("WARNING: couldn't delete image docker volume for cluster %s\n%+v", cluster.name, err)
+		if current, err := getCurrentCluster(); err == nil && current == name {
+			if err := setCurrentCluster(""); err != nil {
+				log.WithField("cluster", name).Warnf("couldn't unselect cluster\n%+v", err)
+			}
 		}
-
-		log.Printf("SUCCESS: removed cluster [%s]", cluster.name)
 	}
 
 	return nil
@@ -278,37 +207,20 @@ func DeleteCluster(c *cli.Context) error {
 
 // StopCluster stops a running cluster container (restartable)
 func StopCluster(c *cli.Context) error {
-	clusters, err := getClusters(c.Bool("all"), c.String("name"))
-
+	ctx := getContext(c)
+	rt, err := getRuntime(c)
 	if err != nil {
 		return err
 	}
-
-	ctx := context.Background()
-	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	names, err := getClusterNames(ctx, rt, c)
 	if err != nil {
-		return fmt.Errorf("ERROR: couldn't create docker client\n%+v", err)
+		return err
 	}
 
-	// remove clusters one by one instead of appending all names to the docker command
-	// this allows for more granular error handling and logging
-	for _, cluster := range clusters {
-		log.Printf("Stopping cluster [%s]", cluster.name)
-		if len(cluster.workers) > 0 {
-			log.Printf("...Stopping %d workers\n", len(cluster.workers))
-			for _, worker := range cluster.workers {
-				if err := docker.ContainerStop(ctx, worker.ID, nil); err != nil {
-					log.Println(err)
-					continue
-				}
-			}
-		}
-		log.Println("...Stopping server")
-		if err := docker.ContainerStop(ctx, cluster.server.ID, nil); err != nil {
-			return fmt.Errorf("ERROR: Couldn't stop server for cluster %s\n%+v", cluster.name, err)
+	for _, name := range names {
+		if err := cluster.Stop(ctx, rt, name); err != nil {
+			return err
 		}
-
-		log.Printf("SUCCESS: Stopped cluster [%s]", cluster.name)
 	}
 
 	return nil
@@ -316,39 +228,20 @@ func StopCluster(c *cli.Context) error {
 
 // StartCluster starts a stopped cluster container
 func StartCluster(c *cli.Context) error {
-	clusters, err := getClusters(c.Bool("all"), c.String("name"))
-
+	ctx := getContext(c)
+	rt, err := getRuntime(c)
 	if err != nil {
 		return err
 	}
-
-	ctx := context.Background()
-	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	names, err := getClusterNames(ctx, rt, c)
 	if err != nil {
-		return fmt.Errorf("ERROR: couldn't create docker client\n%+v", err)
+		return err
 	}
 
-	// remove clusters one by one instead of appending all names to the docker command
-	// this allows for more granular error handling and logging
-	for _, cluster := range clusters {
-		log.Printf("Starting cluster [%s]", cluster.name)
-
-		log.Println("...Starting server")
-		if err := docker.ContainerStart(ctx, cluster.server.ID, types.ContainerStartOptions{}); err != nil {
-			return fmt.Errorf("ERROR: Couldn't start server for cluster %s\n%+v", cluster.name, err)
+	for _, name := range names {
+		if err := cluster.Start(ctx, rt, name); err != nil {
+			return err
 		}
-
-		if len(cluster.workers) > 0 {
-			log.Printf("...Starting %d workers\n", len(cluster.workers))
-			for _, worker := range cluster.workers {
-				if err := docker.ContainerStart(ctx, worker.ID, types.ContainerStartOptions{}); err != nil {
-					log.Println(err)
-					continue
-				}
-			}
-		}
-
-		log.Printf("SUCCESS: Started cluster [%s]", cluster.name)
 	}
 
 	return nil
@@ -357,29 +250,104 @@ func StartCluster(c *cli.Context) error {
 // ListClusters prints a list of created clusters
 func ListClusters(c *cli.Context) error {
 	if c.IsSet("all") {
-		log.Println("INFO: --all is on by default, thus no longer required. This option will be removed in v2.0.0")
+		log.Info("--all is on by default, thus no longer required. This option will be removed in v2.0.0")
 
 	}
-	printClusters()
-	return nil
+	output := c.String("output")
+	if output != "" && output != "wide" {
+		return fmt.Errorf("unknown output format [%s] (supported: wide)", output)
+	}
+	rt, err := getRuntime(c)
+	if err != nil {
+		return err
+	}
+	return printClusters(getContext(c), rt, output == "wide")
 }
 
 // GetKubeConfig grabs the kubeconfig from the running cluster and prints the path to stdout
 func GetKubeConfig(c *cli.Context) error {
-	cluster := c.String("name")
-	kubeConfigPath, err := getKubeConfig(cluster)
+	ctx := getContext(c)
+	rt, err := getRuntime(c)
+	if err != nil {
+		return err
+	}
+	clusterNames, err := getClusterNames(ctx, rt, c)
 	if err != nil {
 		return err
 	}
 
-	// output kubeconfig file path to stdout
-	fmt.Println(kubeConfigPath)
+	merge := c.Bool("merge") || c.Bool("switch-context") || c.IsSet("kubeconfig")
+
+	// write the kubeconfig to stdout or an arbitrary file instead of the cluster directory
+	if output := c.String("output"); output != "" {
+		if merge {
+			return fmt.Errorf("--output can't be combined with --merge, use --kubeconfig instead")
+		}
+		config, err := cluster.KubeConfigs(ctx, rt, clusterNames, c.Bool("internal"))
+		if err != nil {
+			return err
+		}
+		if output == "-" {
+			_, err := os.Stdout.Write(config)
+			return err
+		}
+		if err := writeFile(output, config); err != nil {
+			return err
+		}
+		fmt.Println(output)
+		return nil
+	}
+
+	// merge the clusters into the user's kubeconfig instead of separate kubeconfig files
+	if merge {
+		if c.Bool("internal") {
+			return fmt.Errorf("--internal can't be combined with --merge")
+		}
+		if c.Bool("switch-context") && len(clusterNames) > 1 {
+			return fmt.Errorf("--switch-context can't be used for multiple clusters")
+		}
+		kubeConfigPaths := []string{}
+		for _, name := range clusterNames {
+			kubeConfigPath, err := cluster.MergeKubeConfig(ctx, rt, name, c.String("kubeconfig"), c.Bool("switch-context"), c.Bool("overwrite"))
+			if err != nil {
+				return err
+			}
+			if !containsString(kubeConfigPaths, kubeConfigPath) {
+				kubeConfigPaths = append(kubeConfigPaths, kubeConfigPath)
+			}
+		}
+		fmt.Println(strings.Join(kubeConfigPaths, "\n"))
+		return nil
+	}
+
+	for _, name := range clusterNames {
+		kubeConfigPath, err := cluster.KubeConfigPath(ctx, rt, name, c.Bool("overwrite"), c.Bool("internal"))
+		if err != nil {
+			return err
+		}
+
+		// output kubeconfig file path to stdout
+		fmt.Println(kubeConfigPath)
+	}
 	return nil
 }
 
 // Shell starts a new subshell with the KUBECONFIG pointing to the selected cluster
 func Shell(c *cli.Context) error {
-	return subShell(c.String("name"), c.String("shell"), c.String("command"))
+	rt, err := getRuntime(c)
+	if err != nil {
+		return err
+	}
+	return subShell(getContext(c), rt, c.String("name"), c.String("shell"), c.String("command"))
+}
+
+// Env prints the shell statements that point the current shell to the cluster (KUBECONFIG, K3D_CLUSTER)
+func Env(c *cli.Context) error {
+	rt, err := getRuntime(c)
+	if err != nil {
+		return err
+	}
+	return printEnv(getContext(c), rt, c.String("name"), c.String("shell"))
 }
 
 // ImportImage saves an image locally and imports it into the k3d containers
@@ -390,5 +358,161 @@ func ImportImage(c *cli.Context) error {
 	} else {
 		images = append(images, c.Args()...)
 	}
-	return importImage(c.String("name"), images, c.Bool("no-remove"))
+	rt, err := getRuntime(c)
+	if err != nil {
+		return err
+	}
+	return cluster.ImportImages(getContext(c), rt, c.String("name"), images, c.Bool("no-remove"))
+}
+
+// ListImages prints the images in the nodes of a cluster together with their size and the nodes that have them
+func ListImages(c *cli.Context) error {
+	rt, err := getRuntime(c)
+	if err != nil {
+		return err
+	}
+	images, err := cluster.ListImages(getContext(c), rt, c.String("name"))
+	if err != nil {
+		return err
+	}
+
+	if len(images) == 0 {
+		log.WithField("cluster", c.String("name")).Infof("No images found in cluster [%s]", c.String("name"))
+		return nil
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeader([]string{"IMAGE", "SIZE", "NODES"})
+	for _, image := range images {
+		table.Append([]string{image.Ref, units.HumanSize(float64(image.Size)), strings.Join(image.Nodes, ",")})
+	}
+	table.Render()
+
+	return nil
+}
+
+// RemoveImages removes a list of images from all nodes of a cluster
+func RemoveImages(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return fmt.Errorf("no images specified")
+	}
+	rt, err := getRuntime(c)
+	if err != nil {
+		return err
+	}
+	return cluster.RemoveImages(getContext(c), rt, c.String("name"), c.Args())
+}
+
+// ExportImage exports an image from the cluster nodes into a tarball or into the local docker daemon
+func ExportImage(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("please specify exactly one image to export")
+	}
+	rt, err := getRuntime(c)
+	if err != nil {
+		return err
+	}
+	return cluster.ExportImage(getContext(c), rt, c.String("name"), c.Args().First(), c.String("output"), c.GlobalBool("verbose"))
+}
+
+// CreateUser creates a kubeconfig for a restricted user of the cluster and prints its path to stdout
+func CreateUser(c *cli.Context) error {
+	name := c.String("name")
+	rt, err := getRuntime(c)
+	if err != nil {
+		return err
+	}
+	config, err := cluster.CreateUserKubeConfig(getContext(c), rt, name, cluster.UserSpec{
+		Name:        c.String("user"),
+		Groups:      c.StringSlice("group"),
+		ClusterRole: c.String("clusterrole"),
+	})
+	if err != nil {
+		return err
+	}
+
+	output := c.String("output")
+	if output == "-" {
+		_, err := os.Stdout.Write(config)
+		return err
+	}
+	if output == "" {
+		if output, err = cluster.UserKubeConfigPath(name, c.String("user")); err != nil {
+			return err
+		}
+	}
+	if err := writeFile(output, config); err != nil {
+		return err
+	}
+	fmt.Println(output)
+	return nil
+}
+
+// UseCluster selects the cluster that commands run against if no --name is given and switches the kubeconfig context to it.
+// Without arguments, it prints the currently selected cluster.
+func UseCluster(c *cli.Context) error {
+	if c.NArg() == 0 {
+		current, err := getCurrentCluster()
+		if err != nil {
+			return fmt.Errorf("couldn't read current cluster\n%w", err)
+		}
+		if current == "" {
+			log.Info("No cluster selected, commands use the default cluster unless --name is given")
+			return nil
+		}
+		fmt.Println(current)
+		return nil
+	}
+
+	name := c.Args().First()
+	rt, err := getRuntime(c)
+	if err != nil {
+		return err
+	}
+	if _, err := cluster.Get(getContext(c), rt, name); err != nil {
+		return err
+	}
+
+	if err := setCurrentCluster(name); err != nil {
+		return fmt.Errorf("couldn't set current cluster\n%w", err)
+	}
+	logger := log.WithField("cluster", name)
+	logger.Infof("Using cluster [%s]", name)
+
+	switched, err := cluster.SwitchKubeConfigContext(name)
+	if err != nil {
+		logger.Warnf("couldn't switch kubeconfig context to cluster [%s]\n%+v", name, err)
+	} else if switched {
+		logger.Infof("Switched kubeconfig context to [k3d-%s]", name)
+	} else {
+		logger.Infof("Cluster [%s] is not in your kubeconfig, run `%s get-kubeconfig --name %s --merge --switch-context` to add it", name, os.Args[0], name)
+	}
+	return nil
+}
+
+// UseCurrentCluster makes --name default to the cluster selected with `k3d use` (meant to be used as a command's Before function)
+func UseCurrentCluster(c *cli.Context) error {
+	if c.IsSet("name") {
+		return nil
+	}
+	current, err := getCurrentCluster()
+	if err != nil {
+		log.Warnf("couldn't read current cluster, using [%s]\n%+v", c.String("name"), err)
+		return nil
+	}
+	if current == "" {
+		return nil
+	}
+	return c.Set("name", current)
+}
+
+// containsString checks whether the slice contains the string s
+func containsString(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
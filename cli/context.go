@@ -0,0 +1,42 @@
+package run
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// commandContext is the context that all container runtime calls of a command use, see getContext
+var commandContext context.Context
+
+// getContext returns the context of the command, which is created once on first use. It is canceled on SIGINT
+// or SIGTERM (a second signal terminates k3d right away) and once the time given with --timeout is exceeded.
+func getContext(c *cli.Context) context.Context {
+	if commandContext != nil {
+		return commandContext
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout := c.GlobalDuration("timeout"); timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		log.Warnf("Received %s, canceling... (repeat to exit right away)", sig)
+		cancel()
+	}()
+
+	commandContext = ctx
+	return commandContext
+}
@@ -0,0 +1,60 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rancher/k3d/cluster"
+)
+
+// Exit codes of k3d for the different kinds of errors (see docs/documentation.md)
+const (
+	ExitCodeError              = 1
+	ExitCodeClusterExists      = 3
+	ExitCodeClusterNotFound    = 4
+	ExitCodePortInUse          = 5
+	ExitCodeTimeout            = 6
+	ExitCodeRuntimeUnavailable = 7
+	// ExitCodeInterrupted follows the shell convention for processes terminated by SIGINT (128 + 2)
+	ExitCodeInterrupted = 130
+)
+
+// flagError explains the errors of the cluster package that are caused by a flag of the create and run commands
+func flagError(err error) error {
+	if errors.Is(err, cluster.ErrRestartPolicyUnsupported) {
+		return fmt.Errorf("--auto-restart is not supported with podman, since there is no daemon restarting the containers\n%w", err)
+	}
+	return err
+}
+
+// ExitCode returns the exit code for an error returned by a command
+func ExitCode(err error) int {
+	// the errors of the container runtime don't always tell that the command context was done
+	if err != nil && commandContext != nil {
+		switch commandContext.Err() {
+		case context.DeadlineExceeded:
+			return ExitCodeTimeout
+		case context.Canceled:
+			return ExitCodeInterrupted
+		}
+	}
+
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, cluster.ErrClusterExists):
+		return ExitCodeClusterExists
+	case errors.Is(err, cluster.ErrClusterNotFound):
+		return ExitCodeClusterNotFound
+	case errors.Is(err, cluster.ErrPortInUse):
+		return ExitCodePortInUse
+	case errors.Is(err, cluster.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return ExitCodeTimeout
+	case errors.Is(err, context.Canceled):
+		return ExitCodeInterrupted
+	case errors.Is(err, cluster.ErrRuntimeUnavailable):
+		return ExitCodeRuntimeUnavailable
+	}
+	return ExitCodeError
+}
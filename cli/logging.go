@@ -0,0 +1,36 @@
+package run
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// SetupLogging configures the log level and format from the global flags (meant to be used as the app's Before function).
+// Logs always go to stderr, so that stdout only carries the results of the commands, e.g. kubeconfig paths.
+func SetupLogging(c *cli.Context) error {
+	log.SetOutput(os.Stderr)
+
+	level := c.GlobalString("log-level")
+	if c.GlobalBool("verbose") && !c.GlobalIsSet("log-level") {
+		level = "debug"
+	}
+	logLevel, err := log.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("unknown log level %s (supported: debug, info, warn, error)", level)
+	}
+	log.SetLevel(logLevel)
+
+	switch c.GlobalString("log-format") {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %s (supported: text, json)", c.GlobalString("log-format"))
+	}
+
+	return nil
+}
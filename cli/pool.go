@@ -0,0 +1,59 @@
+package run
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/k3d/cluster"
+)
+
+// parsePool parses a node pool given with --pool as comma-separated key=value pairs
+// (e.g. name=highmem,count=2,image=rancher/k3s:v1.0.0,label=tier=db,memory=4g).
+// The keys for lists (arg, env, volume, port, label and taint) can be repeated.
+func parsePool(poolSpec string) (cluster.Pool, error) {
+	pool := cluster.Pool{Count: 1}
+	for _, option := range strings.Split(poolSpec, ",") {
+		keyValue := strings.SplitN(option, "=", 2)
+		if len(keyValue) != 2 || keyValue[1] == "" {
+			return pool, fmt.Errorf("Invalid option [%s] in node pool [%s] (Format: key=value)", option, poolSpec)
+		}
+		key, value := keyValue[0], keyValue[1]
+		switch key {
+		case "name":
+			pool.Name = value
+		case "count":
+			count, err := strconv.Atoi(value)
+			if err != nil {
+				return pool, fmt.Errorf("Invalid count [%s] in node pool [%s]\n%w", value, poolSpec, err)
+			}
+			pool.Count = count
+		case "image":
+			pool.Image = value
+		case "arg", "agent-arg":
+			pool.AgentArgs = append(pool.AgentArgs, value)
+		case "env":
+			pool.Env = append(pool.Env, value)
+		case "volume":
+			pool.Volumes = append(pool.Volumes, value)
+		case "port", "publish":
+			pool.Publish = append(pool.Publish, value)
+		case "label", "node-label":
+			pool.NodeLabels = append(pool.NodeLabels, value)
+		case "taint", "node-taint":
+			pool.NodeTaints = append(pool.NodeTaints, value)
+		case "memory":
+			pool.Memory = value
+		case "cpus":
+			pool.CPUs = value
+		case "pids-limit":
+			pool.PidsLimit = value
+		default:
+			return pool, fmt.Errorf("Unknown option [%s] in node pool [%s] (supported: name, count, image, arg, env, volume, port, label, taint, memory, cpus, pids-limit)", key, poolSpec)
+		}
+	}
+	if pool.Name == "" {
+		return pool, fmt.Errorf("Node pool [%s] needs a name", poolSpec)
+	}
+	return pool, nil
+}
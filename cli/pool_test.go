@@ -0,0 +1,62 @@
+package run
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rancher/k3d/cluster"
+)
+
+func TestParsePool(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    cluster.Pool
+		wantErr bool
+	}{
+		{"name=edge", cluster.Pool{Name: "edge", Count: 1}, false},
+		{"name=highmem,count=2,image=rancher/k3s:v0.10.0,memory=4g,cpus=1.5,pids-limit=4096", cluster.Pool{
+			Name:      "highmem",
+			Count:     2,
+			Image:     "rancher/k3s:v0.10.0",
+			Memory:    "4g",
+			CPUs:      "1.5",
+			PidsLimit: "4096",
+		}, false},
+		// values are split at the first `=` only, list options can be repeated
+		{"name=db,label=tier=db,node-label=disk=ssd,taint=dedicated=db:NoSchedule,env=A=1,env=B=2", cluster.Pool{
+			Name:       "db",
+			Count:      1,
+			NodeLabels: []string{"tier=db", "disk=ssd"},
+			NodeTaints: []string{"dedicated=db:NoSchedule"},
+			Env:        []string{"A=1", "B=2"},
+		}, false},
+		{"name=edge,arg=--node-ip=10.0.0.1,agent-arg=--debug,volume=/tmp:/data,port=8443:443,publish=8080:80", cluster.Pool{
+			Name:      "edge",
+			Count:     1,
+			AgentArgs: []string{"--node-ip=10.0.0.1", "--debug"},
+			Volumes:   []string{"/tmp:/data"},
+			Publish:   []string{"8443:443", "8080:80"},
+		}, false},
+		// every comma starts a new option, so values can't contain commas
+		{"name=edge,env=NO_PROXY=localhost,127.0.0.1", cluster.Pool{}, true},
+		{"name=edge,", cluster.Pool{}, true},
+		{"name=edge,,count=2", cluster.Pool{}, true},
+		{"name=edge,count", cluster.Pool{}, true},
+		{"name=edge,image=", cluster.Pool{}, true},
+		{"name=edge,count=two", cluster.Pool{}, true},
+		{"name=edge,size=2", cluster.Pool{}, true},
+		{"count=2", cluster.Pool{}, true},
+		{"", cluster.Pool{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			got, err := parsePool(test.spec)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parsePool(%q) = %v, want error: %t", test.spec, err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parsePool(%q) = %+v, want %+v", test.spec, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package run
+
+/*
+ * This file contains the logic of `k3d run`, which wraps a command with a temporary cluster
+ */
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/rancher/k3d/cluster"
+	"github.com/rancher/k3d/runtimes"
+	log "github.com/sirupsen/logrus"
+)
+
+// runCommand creates the cluster, runs the command with KUBECONFIG and K3D_CLUSTER pointing to it and returns the
+// command's exit code. The cluster is deleted afterwards, unless keepOnFailure is set and the command failed.
+func runCommand(ctx context.Context, rt runtimes.Runtime, spec cluster.Spec, args []string, keepOnFailure bool) (exitCode int, err error) {
+	if _, err := cluster.Create(ctx, rt, spec); err != nil {
+		return 0, flagError(err)
+	}
+
+	// delete the cluster whatever happens to the command, as long as k3d itself is still alive
+	defer func() {
+		if keepOnFailure && (exitCode != 0 || err != nil) {
+			log.WithField("cluster", spec.Name).Infof("Keeping cluster [%s] for debugging, delete it with `%s delete --name %s`", spec.Name, os.Args[0], spec.Name)
+			return
+		}
+		// the command context may be canceled already (e.g. by Ctrl-C), which mustn't prevent the cleanup
+		cleanupCtx, cancel := cluster.CleanupContext()
+		defer cancel()
+		if deleteErr := cluster.Delete(cleanupCtx, rt, spec.Name); deleteErr != nil && err == nil {
+			err = deleteErr
+		}
+	}()
+
+	kubeConfigPath, err := cluster.KubeConfigPath(ctx, rt, spec.Name, false, false)
+	if err != nil {
+		return 0, err
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), fmt.Sprintf("KUBECONFIG=%s", kubeConfigPath), fmt.Sprintf("K3D_CLUSTER=%s", spec.Name))
+
+	// k3d must survive the signals to clean up. The command shares k3d's process group, so the terminal delivers
+	// SIGINT and SIGQUIT (Ctrl-C, Ctrl-\) to it directly. Forwarding them would deliver them twice, which programs
+	// may treat as "force quit". SIGTERM and SIGHUP are sent to k3d only, so they are forwarded to the command.
+	ignored := make(chan os.Signal, 1)
+	signal.Notify(ignored, syscall.SIGINT, syscall.SIGQUIT)
+	defer signal.Stop(ignored)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	log.WithField("cluster", spec.Name).Infof("Running %s against cluster [%s]", args, spec.Name)
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("couldn't start command %s\n%w", args, err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-ignored:
+			case sig := <-signals:
+				if err := cmd.Process.Signal(sig); err != nil {
+					log.Warnf("couldn't forward signal %s to command %s\n%+v", sig, args, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitCode := exitErr.ExitCode()
+			// like shells do, report commands killed by a signal with 128 + the signal number
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && exitCode == -1 {
+				exitCode = 128 + int(status.Signal())
+			}
+			log.WithField("cluster", spec.Name).Infof("Command %s exited with code %d", args, exitCode)
+			return exitCode, nil
+		}
+		return 0, fmt.Errorf("command %s failed\n%w", args, err)
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,21 @@
+package run
+
+import (
+	"github.com/rancher/k3d/runtimes"
+	"github.com/urfave/cli"
+)
+
+// containerRuntime is the runtime that the cluster nodes run in, see getRuntime
+var containerRuntime runtimes.Runtime
+
+// getRuntime returns the container runtime selected with --runtime, which is created once on first use
+func getRuntime(c *cli.Context) (runtimes.Runtime, error) {
+	if containerRuntime == nil {
+		rt, err := runtimes.New(c.GlobalString("runtime"))
+		if err != nil {
+			return nil, err
+		}
+		containerRuntime = rt
+	}
+	return containerRuntime, nil
+}
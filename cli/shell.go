@@ -1,57 +1,203 @@
 package run
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
+	"strings"
+	"syscall"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/rancher/k3d/cluster"
+	"github.com/rancher/k3d/runtimes"
 )
 
 type shell struct {
-	Name    string
-	Options []string
-	Prompt  string
-	Env     map[string]string
+	Name string
+	// Posix marks shells that understand POSIX syntax (export, quoting)
+	Posix bool
+	// setup prepares the shell command to load the user's rc files and prefix the prompt.
+	// It returns a cleanup function, that removes everything created for that purpose.
+	setup func(cmd *exec.Cmd, prompt string) (func(), error)
 }
 
 var shells = map[string]shell{
 	"bash": {
-		Name: "bash",
-		Options: []string{
-			"--noprofile", // don't load .profile/.bash_profile
-			"--norc",      // don't load .bashrc
-		},
-		Prompt: "PS1",
+		Name:  "bash",
+		Posix: true,
+		setup: setupBash,
 	},
 	"zsh": {
-		Name: "zsh",
-		Options: []string{
-			"--no-rcs", // don't load .zshrc
-		},
-		Prompt: "PROMPT",
+		Name:  "zsh",
+		Posix: true,
+		setup: setupZsh,
+	},
+	"fish": {
+		Name:  "fish",
+		setup: setupFish,
+	},
+	"sh": {
+		Name:  "sh",
+		Posix: true,
+		setup: setupSh,
 	},
 }
 
-// subShell
-func subShell(cluster, shell, command string) error {
+// shellAliases maps additional names to supported shells
+var shellAliases = map[string]string{
+	"posix": "sh",
+}
 
-	// check if the selected shell is supported
-	if shell == "auto" {
-		shell = path.Base(os.Getenv("SHELL"))
+// getShell resolves the selected shell name ('auto' detects the shell from $SHELL)
+func getShell(name string) (shell, error) {
+	if name == "auto" {
+		name = path.Base(os.Getenv("SHELL"))
+	}
+	if alias, ok := shellAliases[name]; ok {
+		name = alias
 	}
+	selectedShell, ok := shells[name]
+	if !ok {
+		return shell{}, fmt.Errorf("selected shell [%s] is not supported", name)
+	}
+	return selectedShell, nil
+}
 
-	supported := false
-	for supportedShell := range shells {
-		if supportedShell == shell {
-			supported = true
+// exportVariable returns the shell statement that exports an environment variable
+func (s shell) exportVariable(name, value string) string {
+	if s.Posix {
+		return fmt.Sprintf("export %s=%s;", name, quotePosix(value))
+	}
+	// fish
+	return fmt.Sprintf("set -gx %s %s;", name, quoteFish(value))
+}
+
+// quotePosix quotes a string for POSIX shells using single quotes
+func quotePosix(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// quoteFish quotes a string for fish using single quotes
+func quoteFish(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+// writeTempFile writes content to a new temporary file and returns its path
+func writeTempFile(dir, pattern, content string) (string, error) {
+	f, err := ioutil.TempFile(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// setupBash uses a temporary rc file, which loads ~/.bashrc before setting the prompt
+func setupBash(cmd *exec.Cmd, prompt string) (func(), error) {
+	rcFile, err := writeTempFile("", "k3d-bashrc-", fmt.Sprintf(`[ -f ~/.bashrc ] && . ~/.bashrc
+PS1=%s"$PS1"
+`, quotePosix(prompt)))
+	if err != nil {
+		return nil, err
+	}
+	cmd.Args = append(cmd.Args, "--rcfile", rcFile)
+	return func() { os.Remove(rcFile) }, nil
+}
+
+// setupZsh uses a temporary $ZDOTDIR, whose rc files load the user's rc files before setting the prompt
+func setupZsh(cmd *exec.Cmd, prompt string) (func(), error) {
+	zDotDir := os.Getenv("ZDOTDIR")
+	if zDotDir == "" {
+		homeDir, err := homedir.Dir()
+		if err != nil {
+			return nil, err
 		}
+		zDotDir = homeDir
+	}
+
+	tmpDir, err := ioutil.TempDir("", "k3d-zsh-")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+
+	// zsh reads .zshenv and .zshrc from $ZDOTDIR, so we restore the original $ZDOTDIR in .zshrc
+	zshenv := fmt.Sprintf("[ -f %[1]s/.zshenv ] && . %[1]s/.zshenv\n", quotePosix(zDotDir))
+	zshrc := fmt.Sprintf(`ZDOTDIR=%[1]s
+[ -f "$ZDOTDIR/.zshrc" ] && . "$ZDOTDIR/.zshrc"
+PROMPT=%[2]s"$PROMPT"
+`, quotePosix(zDotDir), quotePosix(prompt))
+	if err := ioutil.WriteFile(path.Join(tmpDir, ".zshenv"), []byte(zshenv), 0600); err != nil {
+		cleanup()
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path.Join(tmpDir, ".zshrc"), []byte(zshrc), 0600); err != nil {
+		cleanup()
+		return nil, err
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("ZDOTDIR=%s", tmpDir))
+	return cleanup, nil
+}
+
+// setupFish wraps the user's fish_prompt function after fish loaded its configuration
+func setupFish(cmd *exec.Cmd, prompt string) (func(), error) {
+	initCommand := fmt.Sprintf("functions -c fish_prompt __k3d_fish_prompt; function fish_prompt; echo -n %s; __k3d_fish_prompt; end", quoteFish(prompt))
+	cmd.Args = append(cmd.Args, "--init-command", initCommand)
+	return func() {}, nil
+}
+
+// setupSh uses a temporary $ENV file (read by interactive POSIX shells), which loads the user's $ENV file before setting the prompt
+func setupSh(cmd *exec.Cmd, prompt string) (func(), error) {
+	envFile, err := writeTempFile("", "k3d-shrc-", fmt.Sprintf(`[ -n "$__K3D_ENV__" ] && [ -f "$__K3D_ENV__" ] && . "$__K3D_ENV__"
+PS1=%s"${PS1:-$ }"
+`, quotePosix(prompt)))
+	if err != nil {
+		return nil, err
 	}
-	if !supported {
-		return fmt.Errorf("ERROR: selected shell [%s] is not supported", shell)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("__K3D_ENV__=%s", os.Getenv("ENV")), fmt.Sprintf("ENV=%s", envFile))
+	return func() { os.Remove(envFile) }, nil
+}
+
+// printEnv prints the shell statements that configure the current shell for the cluster (to be used with eval)
+func printEnv(ctx context.Context, rt runtimes.Runtime, clusterName, shellName string) error {
+	selectedShell, err := getShell(shellName)
+	if err != nil {
+		return err
+	}
+
+	kubeConfigPath, err := cluster.KubeConfigPath(ctx, rt, clusterName, false, false)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(selectedShell.exportVariable("KUBECONFIG", kubeConfigPath))
+	fmt.Println(selectedShell.exportVariable("K3D_CLUSTER", clusterName))
+	if selectedShell.Posix {
+		fmt.Printf("# Run this command to configure your shell:\n# eval \"$(%s env --name %s --shell %s)\"\n", path.Base(os.Args[0]), clusterName, selectedShell.Name)
+	} else {
+		fmt.Printf("# Run this command to configure your shell:\n# eval (%s env --name %s --shell %s)\n", path.Base(os.Args[0]), clusterName, selectedShell.Name)
+	}
+	return nil
+}
+
+// subShell
+func subShell(ctx context.Context, rt runtimes.Runtime, clusterName, shellName, command string) error {
+
+	// check if the selected shell is supported
+	selectedShell, err := getShell(shellName)
+	if err != nil {
+		return err
 	}
 
 	// get kubeconfig for selected cluster
-	kubeConfigPath, err := getKubeConfig(cluster)
+	kubeConfigPath, err := cluster.KubeConfigPath(ctx, rt, clusterName, false, false)
 	if err != nil {
 		return err
 	}
@@ -59,42 +205,43 @@ func subShell(cluster, shell, command string) error {
 	// check if we're already in a subshell
 	subShell := os.ExpandEnv("$__K3D_CLUSTER__")
 	if len(subShell) > 0 {
-		return fmt.Errorf("Error: Already in subshell of cluster %s", subShell)
+		return fmt.Errorf("already in subshell of cluster %s", subShell)
 	}
 
 	// get path of shell executable
-	shellPath, err := exec.LookPath(shell)
+	shellPath, err := exec.LookPath(selectedShell.Name)
 	if err != nil {
 		return err
 	}
 
-	// set shell specific options (command line flags)
-	shellOptions := shells[shell].Options
-
-	cmd := exec.Command(shellPath, shellOptions...)
-
-	if len(command) > 0 {
-		cmd.Args = append(cmd.Args, "-c", command)
-
-	}
+	cmd := exec.Command(shellPath)
 
 	// Set up stdio
 	cmd.Stdout = os.Stdout
 	cmd.Stdin = os.Stdin
 	cmd.Stderr = os.Stderr
 
-	// Set up Promot
-	setPrompt := fmt.Sprintf("%s=[%s} %s", shells[shell].Prompt, cluster, os.Getenv(shells[shell].Prompt))
+	// Set up KUBECONFIG and declare subshell
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("KUBECONFIG=%s", kubeConfigPath),
+		fmt.Sprintf("K3D_CLUSTER=%s", clusterName),
+		fmt.Sprintf("__K3D_CLUSTER__=%s", clusterName),
+	)
 
-	// Set up KUBECONFIG
-	setKube := fmt.Sprintf("KUBECONFIG=%s", kubeConfigPath)
-
-	// Declare subshell
-	subShell = fmt.Sprintf("__K3D_CLUSTER__=%s", cluster)
+	if len(command) > 0 {
+		cmd.Args = append(cmd.Args, "-c", command)
+		return cmd.Run()
+	}
 
-	newEnv := append(os.Environ(), setPrompt, setKube, subShell)
+	// Set up prompt, keeping the user's rc files
+	cleanup, err := selectedShell.setup(cmd, fmt.Sprintf("[%s] ", clusterName))
+	if err != nil {
+		return fmt.Errorf("couldn't set up %s\n%w", selectedShell.Name, err)
+	}
+	defer cleanup()
 
-	cmd.Env = newEnv
+	// the interactive shell handles Ctrl-C itself, k3d mustn't be canceled (or killed) by it
+	signal.Ignore(syscall.SIGINT)
 
 	return cmd.Run()
 }
@@ -0,0 +1,749 @@
+package cluster
+
+/*
+ * This file contains the API to create and manage k3d clusters from Go code.
+ * The k3d CLI (package run) is a thin wrapper around it.
+ */
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/rancher/k3d/runtimes"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultContainerNamePrefix = "k3d"
+	defaultRegistry            = "docker.io"
+	defaultServerCount         = 1
+	// cleanupTimeout limits the time to clean up after a failed or canceled operation
+	cleanupTimeout = time.Minute
+)
+
+// Cluster describes an existing k3d cluster
+type Cluster struct {
+	Name        string
+	Image       string
+	Status      string
+	ServerPorts []string
+	Server      types.Container
+	Workers     []types.Container
+	// Proxy publishes the ports of clusters in an internal network (nil for other clusters)
+	Proxy *types.Container
+}
+
+// Spec describes a cluster to be created
+type Spec struct {
+	Name string
+	// Image is the k3s image used for all nodes (images without registry are pulled from docker.io)
+	Image string
+	// APIPort is the port (Format: [host:]port) that the Kubernetes API server is published on
+	APIPort string
+	Workers int
+	// Volumes are mounted into the selected nodes (Docker notation: source:destination@node-specifier, default: all nodes)
+	Volumes []string
+	// Publish maps node ports to the host (Format: [ip:][host-port:]container-port[/protocol]@node-specifier)
+	Publish []string
+	// PortAutoOffset is added (* worker number) to the host ports published on workers
+	PortAutoOffset int
+	// ServerArgs and AgentArgs are passed to k3s on the selected nodes (Format: argument@node-specifier,
+	// default: all servers or all workers)
+	ServerArgs []string
+	AgentArgs  []string
+	// Env is set on the selected nodes (Format: KEY=value@node-specifier, default: all nodes)
+	Env []string
+	// NodeLabels are set on the selected nodes (Format: key=value@node-specifier, default: all nodes)
+	NodeLabels []string
+	// NodeTaints are set on the selected nodes (Format: key=value:effect@node-specifier, default: all nodes)
+	NodeTaints []string
+	// Memory (e.g. 2g@workers), CPUs (e.g. 1.5@server) and PidsLimit (e.g. 4096) limit the resources of the
+	// selected nodes (default: all nodes)
+	Memory      []string
+	CPUs        []string
+	PidsLimit   []string
+	AutoRestart bool
+	// ImportImages are preloaded from the local docker daemon into every node
+	ImportImages []string
+	// Network is an existing network that the nodes join instead of a network created for the cluster.
+	// It isn't deleted together with the cluster.
+	Network string
+	// Subnet (CIDR), Gateway and IPRange (CIDR) configure the network created for the cluster (default: chosen by docker)
+	Subnet  string
+	Gateway string
+	IPRange string
+	// IPs are static IPs of single nodes (Format: ip@node-specifier, e.g. 172.28.0.10@server)
+	IPs []string
+	// IPv6 creates an IPv6 only cluster (pods and services) in an IPv6-enabled network,
+	// DualStack a cluster with IPv4 and IPv6 addresses for pods and services
+	IPv6      bool
+	DualStack bool
+	// NetworkInternal creates the cluster network without access to the outside (e.g. the internet).
+	// The published ports of the nodes are published by a proxy container instead and all images have to exist locally.
+	NetworkInternal bool
+	// Pools are additional workers grouped in node pools with their own image and options
+	Pools []Pool
+	// ImageCache uses the host-wide image cache shared by all k3d clusters
+	ImageCache bool
+	// Wait waits for the server to be up and running before creating the workers.
+	// Timeout (0 means forever) limits the time to wait.
+	Wait    bool
+	Timeout time.Duration
+	Verbose bool
+}
+
+// GetContainerName generates the container names
+func GetContainerName(role, clusterName string, postfix int) string {
+	if postfix >= 0 {
+		return fmt.Sprintf("%s-%s-%s-%d", defaultContainerNamePrefix, clusterName, role, postfix)
+	}
+	return fmt.Sprintf("%s-%s-%s", defaultContainerNamePrefix, clusterName, role)
+}
+
+// GetAllContainerNames returns a list of all containernames that will be created
+func GetAllContainerNames(clusterName string, serverCount, workerCount int) []string {
+	names := []string{}
+	if serverCount == 1 {
+		// a single server doesn't get a postfix, see createServer
+		names = append(names, GetContainerName("server", clusterName, -1))
+	} else {
+		for postfix := 0; postfix < serverCount; postfix++ {
+			names = append(names, GetContainerName("server", clusterName, postfix))
+		}
+	}
+	for postfix := 0; postfix < workerCount; postfix++ {
+		names = append(names, GetContainerName("worker", clusterName, postfix))
+	}
+	return names
+}
+
+// fullImageName prefixes images without registry with the default registry
+func fullImageName(image string) string {
+	if len(strings.Split(image, "/")) <= 2 {
+		return fmt.Sprintf("%s/%s", defaultRegistry, image)
+	}
+	return image
+}
+
+// Create creates a new cluster (network, image volume, server and worker containers) and its cluster directory.
+// If anything fails (or ctx is canceled) after the network was created, everything created so far is deleted again.
+func Create(ctx context.Context, rt runtimes.Runtime, spec Spec) (_ *Cluster, err error) {
+
+	if err := CheckClusterName(spec.Name); err != nil {
+		return nil, err
+	}
+	logger := log.WithField("cluster", spec.Name)
+
+	if spec.AutoRestart && !rt.SupportsRestartPolicy() {
+		return nil, ErrRestartPolicyUnsupported
+	}
+
+	if cluster, err := getClusters(ctx, rt, false, spec.Name); err != nil {
+		return nil, err
+	} else if len(cluster) != 0 {
+		// A cluster exists with the same name. Return with an error.
+		return nil, &Error{Kind: ErrClusterExists, Cluster: spec.Name, Message: fmt.Sprintf("Cluster %s already exists", spec.Name)}
+	}
+
+	// define image
+	image := fullImageName(spec.Image)
+
+	// the options of the node pools select the pools' nodes by the pools' names
+	if err := validatePools(spec.Name, spec.Pools); err != nil {
+		return nil, err
+	}
+	spec = spec.withPoolOptions()
+
+	// new port map
+	nodeNames := append(GetAllContainerNames(spec.Name, defaultServerCount, spec.Workers), getPoolContainerNames(spec.Name, spec.Pools)...)
+	portmap, err := mapNodesToPortSpecs(spec.Publish, nodeNames)
+	if err != nil {
+		return nil, err
+	}
+
+	// node labels and taints become k3s arguments of the selected nodes
+	nodeArgs, err := mapNodesToNodeArgs(spec.NodeLabels, spec.NodeTaints, nodeNames)
+	if err != nil {
+		return nil, err
+	}
+
+	// volumes, environment variables and k3s arguments given by the user apply to the nodes selected by their
+	// node-specifiers (default: all nodes for volumes and environment variables, all servers or agents for arguments)
+	// Their values may contain `@` themselves, so only known node-specifiers are split off.
+	nodeVolumes, err := mapNodesToValueSpecs(spec.Volumes, nodeNames, "all", "volume")
+	if err != nil {
+		return nil, err
+	}
+	nodeEnv, err := mapNodesToValueSpecs(spec.Env, nodeNames, "all", "environment variable")
+	if err != nil {
+		return nil, err
+	}
+	nodeServerArgs, err := mapNodesToRoleSpecs(spec.ServerArgs, nodeNames, GetAllContainerNames(spec.Name, defaultServerCount, 0), "server", "server", "server argument")
+	if err != nil {
+		return nil, err
+	}
+	workerNames := append(GetAllContainerNames(spec.Name, 0, spec.Workers), getPoolContainerNames(spec.Name, spec.Pools)...)
+	nodeAgentArgs, err := mapNodesToRoleSpecs(spec.AgentArgs, nodeNames, workerNames, "worker", "workers", "agent argument")
+	if err != nil {
+		return nil, err
+	}
+
+	// resource limits of the selected nodes
+	if err := validateResourceSpecs(spec.Memory, spec.CPUs, spec.PidsLimit); err != nil {
+		return nil, err
+	}
+	nodeMemory := mapNodesToSpecs(spec.Memory, nodeNames, "all", "memory limit")
+	nodeCPUs := mapNodesToSpecs(spec.CPUs, nodeNames, "all", "CPU limit")
+	nodePidsLimit := mapNodesToSpecs(spec.PidsLimit, nodeNames, "all", "PIDs limit")
+	hostInfo := types.Info{}
+	if len(spec.Memory) > 0 || len(spec.CPUs) > 0 {
+		// the kubelet reserves the resources of the host exceeding the limits
+		if hostInfo, err = rt.Info(ctx); err != nil {
+			return nil, &Error{Kind: ErrRuntimeUnavailable, Message: "couldn't get the resources of the container runtime's host", Err: err}
+		}
+	}
+
+	apiPort, err := parseAPIPort(spec.APIPort)
+	if err != nil {
+		return nil, err
+	}
+
+	// network options and static IPs, which have to select single nodes (not node pools)
+	containerNames := []string{}
+	for _, name := range nodeNames {
+		if !isPoolName(spec.Pools, name) {
+			containerNames = append(containerNames, name)
+		}
+	}
+	if err := validateNetworkSpec(spec, containerNames); err != nil {
+		return nil, err
+	}
+	nodeIPs := mapNodesToSpecs(spec.IPs, containerNames, "", "static IP")
+	if spec.NetworkInternal {
+		if err := checkLocalImages(ctx, rt, requiredImages(spec, image)); err != nil {
+			return nil, contextError(ctx, err)
+		}
+		if len(spec.ImportImages) == 0 {
+			logger.Warn("Nodes in an internal network can't pull images, preload the images of k3s' system pods and your workloads with --import-image")
+		}
+	}
+
+	// create cluster network (or use the existing one)
+	networkName, err := setupClusterNetwork(ctx, rt, spec)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	// On error remove all resources allocated for the cluster so far, so that they don't linger around
+	defer func() {
+		if err != nil {
+			err = contextError(ctx, err)
+			rollback(rt, spec.Name)
+		}
+	}()
+
+	// environment variables shared by all nodes
+	env := []string{"K3S_KUBECONFIG_OUTPUT=/output/kubeconfig.yaml"}
+	env = append(env, fmt.Sprintf("K3S_CLUSTER_SECRET=%s", GenerateRandomString(20)))
+
+	// k3s server arguments
+	k3AgentArgs := []string{}
+	k3sServerArgs := []string{"--https-listen-port", apiPort.Port}
+
+	// When the 'host' is not provided by --api-port, try to fill it using Docker Machine's IP address.
+	if apiPort.Host == "" {
+		apiPort.Host, err = getDockerMachineIp()
+		// IP address is the same as the host
+		apiPort.HostIP = apiPort.Host
+		// In case of error, Log a warning message, and continue on. Since it more likely caused by a miss configured
+		// DOCKER_MACHINE_NAME environment variable.
+		if err != nil {
+			logger.Warn("Failed to get docker machine IP address, ignoring the DOCKER_MACHINE_NAME environment variable setting.")
+		}
+	}
+
+	if apiPort.Host != "" {
+		// Add TLS SAN for non default host name
+		logger.Infof("Add TLS SAN for %s", apiPort.Host)
+		k3sServerArgs = append(k3sServerArgs, "--tls-san", apiPort.Host)
+	}
+
+	// IP ranges of pods and services for IPv6 only or dual-stack clusters
+	k3sServerArgs = append(k3sServerArgs, spec.ipFamilyServerArgs()...)
+
+	// Add TLS SAN for the server container name, so that containers in the cluster network
+	// can reach the API server directly (see `k3d get-kubeconfig --internal`)
+	k3sServerArgs = append(k3sServerArgs, "--tls-san", GetContainerName("server", spec.Name, -1))
+
+	// create a docker volume for sharing image tarballs with the cluster
+	imageVolume, err := createImageVolume(ctx, rt, spec.Name)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("Created docker volume %s", imageVolume.Name)
+	volumes := []string{fmt.Sprintf("%s:%s", imageVolume.Name, imageBasePathRemote)}
+
+	// the shared image cache is mounted read-only into every node. The cache volume outlives the cluster.
+	if spec.ImageCache {
+		if _, err := createImageCacheVolume(ctx, rt); err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, fmt.Sprintf("%s:%s:ro", imageCacheVolumeName, imageCachePathRemote))
+	}
+
+	// preload images: save them as a tarball into a dedicated preload volume, which is mounted into k3s' agent images
+	// directory, so that every node imports them at boot before any workload is scheduled.
+	// The image volume isn't mounted there, since tarballs kept in it (e.g. exported images) would be imported as well.
+	// Neither is the shared image cache, which holds the images of other clusters: the requested images are saved
+	// into the cache and imported from there once the nodes are up.
+	var cachedImageFileNames []string
+	if len(spec.ImportImages) > 0 {
+		if spec.ImageCache {
+			cachedImageFileNames, err = saveImagesToCache(ctx, rt, spec.Name, spec.ImportImages)
+		} else {
+			var preloadVolume types.Volume
+			if preloadVolume, err = createPreloadVolume(ctx, rt, spec.Name); err == nil {
+				err = saveImages(ctx, rt, spec.Name, preloadVolume.Name, spec.ImportImages, fmt.Sprintf("%s/k3d-%s-preload.tar", imageBasePathRemote, spec.Name))
+				volumes = append(volumes, fmt.Sprintf("%s:%s:ro", preloadVolume.Name, k3sAgentImagesDir))
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	clusterSpec := &nodeSpec{
+		AgentArgs:           k3AgentArgs,
+		APIPort:             *apiPort,
+		AutoRestart:         spec.AutoRestart,
+		ClusterName:         spec.Name,
+		Env:                 env,
+		HostCPUs:            hostInfo.NCPU,
+		HostMemory:          hostInfo.MemTotal,
+		Image:               image,
+		Network:             networkName,
+		NodeToAgentArgsMap:  nodeAgentArgs,
+		NodeToArgsMap:       nodeArgs,
+		NodeToCPUsMap:       nodeCPUs,
+		NodeToEnvMap:        nodeEnv,
+		NodeToIPMap:         nodeIPs,
+		NodeToMemoryMap:     nodeMemory,
+		NodeToPidsLimitMap:  nodePidsLimit,
+		NodeToPortSpecMap:   portmap,
+		NodeToServerArgsMap: nodeServerArgs,
+		NodeToVolumesMap:    nodeVolumes,
+		PortAutoOffset:      spec.PortAutoOffset,
+		ServerArgs:          k3sServerArgs,
+		Verbose:             spec.Verbose,
+		Volumes:             volumes,
+	}
+	if spec.NetworkInternal {
+		clusterSpec.Proxy = &proxySpec{}
+	}
+
+	// create the server
+	logger.Infof("Creating cluster [%s]", spec.Name)
+
+	// create the directory where we will put the kubeconfig file by default (when running `k3d get-config`)
+	if err := createClusterDir(spec.Name); err != nil {
+		return nil, err
+	}
+
+	dockerID, err := createServer(ctx, rt, clusterSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	// Wait for k3s to be up and running if wanted.
+	// We're simply scanning the container logs for a line that tells us that everything's up and running
+	// TODO: also wait for worker nodes
+	start := time.Now()
+	for spec.Wait {
+		// not running after timeout exceeded? Rollback and delete everything.
+		if spec.Timeout != 0 && time.Now().After(start.Add(spec.Timeout)) {
+			return nil, &Error{Kind: ErrTimeout, Cluster: spec.Name, Message: fmt.Sprintf("Cluster creation exceeded specified timeout (%s)", spec.Timeout)}
+		}
+
+		// scan container logs for a line that tells us that the required services are up and running
+		out, err := rt.ContainerLogs(ctx, dockerID)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get docker logs for %s\n%w", spec.Name, err)
+		}
+		buf := new(bytes.Buffer)
+		nRead, _ := buf.ReadFrom(out)
+		out.Close()
+		output := buf.String()
+		if nRead > 0 && strings.Contains(string(output), "Running kubelet") {
+			break
+		}
+
+		if err := sleep(ctx, 1*time.Second); err != nil {
+			return nil, err
+		}
+	}
+
+	// spin up the worker nodes
+	// TODO: do this concurrently in different goroutines
+	if spec.Workers > 0 {
+		logger.Infof("Booting %s workers for cluster %s", strconv.Itoa(spec.Workers), spec.Name)
+		for i := 0; i < spec.Workers; i++ {
+			workerID, err := createWorker(ctx, rt, clusterSpec, i, i)
+			if err != nil {
+				return nil, err
+			}
+			logger.WithField("node", GetContainerName("worker", spec.Name, i)).Debugf("Created worker with ID %s", workerID)
+		}
+	}
+
+	// spin up the nodes of the node pools, numbering them after the other workers
+	workerIndex := spec.Workers
+	for _, pool := range spec.Pools {
+		poolSpec := *clusterSpec
+		poolSpec.Pool = pool.Name
+		if pool.Image != "" {
+			poolSpec.Image = fullImageName(pool.Image)
+		}
+		logger.Infof("Booting %d workers of node pool [%s] for cluster %s", pool.Count, pool.Name, spec.Name)
+		for i := 0; i < pool.Count; i++ {
+			workerID, err := createWorker(ctx, rt, &poolSpec, i, workerIndex)
+			if err != nil {
+				return nil, err
+			}
+			workerIndex++
+			logger.WithField("node", GetContainerName(pool.Name, spec.Name, i)).Debugf("Created worker with ID %s", workerID)
+		}
+	}
+
+	// import the requested images from the shared image cache
+	if len(cachedImageFileNames) > 0 {
+		nodes, err := getClusterNodes(ctx, rt, spec.Name)
+		if err != nil {
+			return nil, err
+		}
+		if err := importCachedTarballs(ctx, rt, spec.Name, nodes, spec.ImportImages, cachedImageFileNames); err != nil {
+			return nil, err
+		}
+	}
+
+	// publish the ports of the nodes in the internal network
+	if clusterSpec.Proxy != nil {
+		proxyID, err := createProxy(ctx, rt, clusterSpec)
+		if err != nil {
+			return nil, err
+		}
+		logger.Debugf("Created proxy with ID %s", proxyID)
+	}
+
+	logger.Infof("Created cluster [%s]", spec.Name)
+	return Get(ctx, rt, spec.Name)
+}
+
+// Delete removes the containers, network and image volume belonging to a cluster, its entries in the user's kubeconfig
+// and its local directory
+func Delete(ctx context.Context, rt runtimes.Runtime, name string) error {
+	cluster, err := Get(ctx, rt, name)
+	if err != nil {
+		return err
+	}
+
+	logger := log.WithField("cluster", cluster.Name)
+	logger.Infof("Removing cluster [%s]", cluster.Name)
+	if cluster.Proxy != nil {
+		logger.Info("...Removing proxy")
+		if err := removeContainer(ctx, rt, cluster.Proxy.ID); err != nil {
+			logger.Warn(err)
+		}
+	}
+	if len(cluster.Workers) > 0 {
+		// TODO: this could be done in goroutines
+		logger.Infof("...Removing %d workers", len(cluster.Workers))
+		for _, worker := range cluster.Workers {
+			if err := removeContainer(ctx, rt, worker.ID); err != nil {
+				logger.WithField("node", worker.Names[0][1:]).Warn(err)
+				continue
+			}
+		}
+	}
+	if err := removeKubeConfigEntries(cluster.Name); err != nil {
+		logger.Warnf("couldn't remove cluster from kubeconfig\n%+v", err)
+	}
+	deleteClusterDir(cluster.Name)
+	logger.Info("...Removing server")
+	if err := removeContainer(ctx, rt, cluster.Server.ID); err != nil {
+		return fmt.Errorf("Couldn't remove server for cluster %s\n%w", cluster.Name, err)
+	}
+
+	if err := deleteClusterNetwork(ctx, rt, cluster.Name); err != nil {
+		logger.Warnf("couldn't delete cluster network\n%+v", err)
+	}
+
+	logger.Info("...Removing docker image volume")
+	if err := deleteImageVolume(ctx, rt, cluster.Name); err != nil {
+		logger.Warnf("couldn't delete image docker volume\n%+v", err)
+	}
+
+	logger.Infof("Removed cluster [%s]", cluster.Name)
+	return nil
+}
+
+// rollback removes the containers, network, image volume and directory of a partially created cluster.
+// It doesn't use the context of the creation, since that may be canceled already.
+func rollback(rt runtimes.Runtime, name string) {
+	ctx, cancel := CleanupContext()
+	defer cancel()
+
+	logger := log.WithField("cluster", name)
+	logger.Infof("Rolling back creation of cluster [%s]", name)
+	containers, err := rt.ListContainers(ctx, map[string]string{"app": "k3d", "cluster": name}, true)
+	if err != nil {
+		logger.Warnf("couldn't list containers of the cluster\n%+v", err)
+	}
+	for _, container := range containers {
+		if err := removeContainer(ctx, rt, container.ID); err != nil {
+			logger.Warn(err)
+		}
+	}
+	deleteClusterDir(name)
+	if err := deleteClusterNetwork(ctx, rt, name); err != nil {
+		logger.Warnf("couldn't delete cluster network\n%+v", err)
+	}
+	if err := deleteImageVolume(ctx, rt, name); err != nil {
+		logger.Warnf("couldn't delete image docker volume\n%+v", err)
+	}
+}
+
+// Stop stops the containers of a running cluster (restartable)
+func Stop(ctx context.Context, rt runtimes.Runtime, name string) error {
+	cluster, err := Get(ctx, rt, name)
+	if err != nil {
+		return err
+	}
+
+	logger := log.WithField("cluster", cluster.Name)
+	logger.Infof("Stopping cluster [%s]", cluster.Name)
+	if cluster.Proxy != nil {
+		logger.Info("...Stopping proxy")
+		if err := rt.StopContainer(ctx, cluster.Proxy.ID); err != nil {
+			logger.Warn(err)
+		}
+	}
+	if len(cluster.Workers) > 0 {
+		logger.Infof("...Stopping %d workers", len(cluster.Workers))
+		for _, worker := range cluster.Workers {
+			if err := rt.StopContainer(ctx, worker.ID); err != nil {
+				logger.WithField("node", worker.Names[0][1:]).Warn(err)
+				continue
+			}
+		}
+	}
+	logger.Info("...Stopping server")
+	if err := rt.StopContainer(ctx, cluster.Server.ID); err != nil {
+		return fmt.Errorf("Couldn't stop server for cluster %s\n%w", cluster.Name, err)
+	}
+
+	logger.Infof("Stopped cluster [%s]", cluster.Name)
+	return nil
+}
+
+// Start starts the containers of a stopped cluster
+func Start(ctx context.Context, rt runtimes.Runtime, name string) error {
+	cluster, err := Get(ctx, rt, name)
+	if err != nil {
+		return err
+	}
+
+	logger := log.WithField("cluster", cluster.Name)
+	logger.Infof("Starting cluster [%s]", cluster.Name)
+
+	logger.Info("...Starting server")
+	if err := rt.StartContainer(ctx, cluster.Server.ID); err != nil {
+		return fmt.Errorf("Couldn't start server for cluster %s\n%w", cluster.Name, err)
+	}
+
+	if len(cluster.Workers) > 0 {
+		logger.Infof("...Starting %d workers", len(cluster.Workers))
+		for _, worker := range cluster.Workers {
+			if err := rt.StartContainer(ctx, worker.ID); err != nil {
+				logger.WithField("node", worker.Names[0][1:]).Warn(err)
+				continue
+			}
+		}
+	}
+
+	if cluster.Proxy != nil {
+		logger.Info("...Starting proxy")
+		if err := rt.StartContainer(ctx, cluster.Proxy.ID); err != nil {
+			logger.Warn(err)
+		}
+	}
+
+	logger.Infof("Started cluster [%s]", cluster.Name)
+	return nil
+}
+
+// Get returns the cluster with the given name or an error, if it doesn't exist
+func Get(ctx context.Context, rt runtimes.Runtime, name string) (*Cluster, error) {
+	clusters, err := getClusters(ctx, rt, false, name)
+	if err != nil {
+		return nil, err
+	}
+	cluster, ok := clusters[name]
+	if !ok {
+		return nil, &Error{Kind: ErrClusterNotFound, Cluster: name, Message: fmt.Sprintf("cluster [%s] does not exist", name)}
+	}
+	return &cluster, nil
+}
+
+// List returns all existing clusters sorted by name
+func List(ctx context.Context, rt runtimes.Runtime) ([]Cluster, error) {
+	clusters, err := getClusters(ctx, rt, true, "")
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Cluster, 0, len(clusters))
+	for _, cluster := range clusters {
+		list = append(list, cluster)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// createDirIfNotExists checks for the existence of a directory and creates it along with all required parents if not.
+// It returns an error if the directory (or parents) couldn't be created and nil if it worked fine or if the path already exists.
+func createDirIfNotExists(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return os.MkdirAll(path, os.ModePerm)
+	}
+	return nil
+}
+
+// createClusterDir creates a directory with the cluster name under $HOME/.config/k3d/<cluster_name>.
+// The cluster directory will be used e.g. to store the kubeconfig file.
+func createClusterDir(name string) error {
+	clusterPath, err := getClusterDir(name)
+	if err != nil {
+		return err
+	}
+	if err := createDirIfNotExists(clusterPath); err != nil {
+		return fmt.Errorf("couldn't create cluster directory [%s] -> %w", clusterPath, err)
+	}
+	// create subdir for sharing container images
+	if err := createDirIfNotExists(clusterPath + "/images"); err != nil {
+		return fmt.Errorf("couldn't create cluster sub-directory [%s] -> %w", clusterPath+"/images", err)
+	}
+	return nil
+}
+
+// deleteClusterDir contrary to createClusterDir, this deletes the cluster directory under $HOME/.config/k3d/<cluster_name>
+func deleteClusterDir(name string) {
+	clusterPath, _ := getClusterDir(name)
+	if err := os.RemoveAll(clusterPath); err != nil {
+		log.WithField("cluster", name).Warnf("couldn't delete cluster directory [%s]. You might want to delete it manually.", clusterPath)
+	}
+}
+
+// ConfigDir returns the directory that k3d keeps its files in, which is $HOME/.config/k3d
+func ConfigDir() (string, error) {
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		log.Error("Couldn't get user's home directory")
+		return "", err
+	}
+	return path.Join(homeDir, ".config", "k3d"), nil
+}
+
+// getClusterDir returns the path to the cluster directory which is $HOME/.config/k3d/<cluster_name>
+func getClusterDir(name string) (string, error) {
+	configDir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(configDir, name), nil
+}
+
+// Classify cluster state: Running, Stopped or Abnormal
+func getClusterStatus(server types.Container, workers []types.Container) string {
+	// The cluster is in the abnromal state when server state and the worker
+	// states don't agree.
+	for _, w := range workers {
+		if w.State != server.State {
+			return "unhealthy"
+		}
+	}
+
+	switch server.State {
+	case "exited": // All containers in this state are most likely
+		// as the result of running the "k3d stop" command.
+		return "stopped"
+	}
+
+	return server.State
+}
+
+// getClusters uses the container runtime to get existing clusters and compares that with the list of cluster directories
+// When 'all' is true, 'cluster' contains all clusters found by the container runtime
+// When 'all' is false, 'cluster' contains up to one cluster whose name matches 'name'. 'cluster' can
+// be empty if no matching cluster is found.
+func getClusters(ctx context.Context, rt runtimes.Runtime, all bool, name string) (map[string]Cluster, error) {
+	// get all servers created by k3d
+	k3dServers, err := rt.ListContainers(ctx, map[string]string{"app": "k3d", "component": "server"}, true)
+	if err != nil {
+		return nil, &Error{Kind: ErrRuntimeUnavailable, Message: "couldn't list server containers", Err: err}
+	}
+
+	clusters := make(map[string]Cluster)
+
+	// for all servers created by k3d, get workers and cluster information
+	for _, server := range k3dServers {
+		clusterName := server.Labels["cluster"]
+
+		// Skip the cluster if we don't want all of them, and
+		// the cluster name does not match.
+		if all || name == clusterName {
+
+			// get workers
+			workers, err := rt.ListContainers(ctx, map[string]string{"app": "k3d", "cluster": clusterName, "component": "worker"}, true)
+			if err != nil {
+				log.WithField("cluster", clusterName).Warnf("couldn't get worker containers\n%+v", err)
+			}
+
+			// get the proxy publishing the ports of a cluster in an internal network
+			var proxy *types.Container
+			proxies, err := rt.ListContainers(ctx, map[string]string{"app": "k3d", "cluster": clusterName, "component": "proxy"}, true)
+			if err != nil {
+				log.WithField("cluster", clusterName).Warnf("couldn't get proxy container\n%+v", err)
+			}
+			published := server.Ports
+			if len(proxies) > 0 {
+				proxy = &proxies[0]
+				published = proxy.Ports
+			}
+
+			// save cluster information
+			serverPorts := []string{}
+			for _, port := range published {
+				serverPorts = append(serverPorts, strconv.Itoa(int(port.PublicPort)))
+			}
+			clusters[clusterName] = Cluster{
+				Name:        clusterName,
+				Image:       server.Image,
+				Status:      getClusterStatus(server, workers),
+				ServerPorts: serverPorts,
+				Server:      server,
+				Workers:     workers,
+				Proxy:       proxy,
+			}
+		}
+	}
+
+	return clusters, nil
+}
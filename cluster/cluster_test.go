@@ -0,0 +1,197 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher/k3d/runtimes"
+)
+
+// testSpec returns the spec of a small cluster for the tests
+func testSpec() Spec {
+	return Spec{
+		Name:    "test",
+		Image:   "rancher/k3s:v1",
+		APIPort: "6550",
+		Workers: 2,
+	}
+}
+
+// assertNothingLeft checks that no container, network, volume or directory of the cluster is left behind
+func assertNothingLeft(t *testing.T, rt runtimes.Runtime, name string) {
+	t.Helper()
+	ctx := context.Background()
+	labels := map[string]string{"app": "k3d", "cluster": name}
+
+	if containers, err := rt.ListContainers(ctx, labels, true); err != nil || len(containers) > 0 {
+		t.Errorf("containers of cluster [%s] left behind: %v (%v)", name, containers, err)
+	}
+	if networks, err := rt.ListNetworks(ctx, labels); err != nil || len(networks) > 0 {
+		t.Errorf("networks of cluster [%s] left behind: %v (%v)", name, networks, err)
+	}
+	if volumes, err := rt.ListVolumes(ctx, labels); err != nil || len(volumes) > 0 {
+		t.Errorf("volumes of cluster [%s] left behind: %v (%v)", name, volumes, err)
+	}
+	clusterDir, err := getClusterDir(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(clusterDir); !os.IsNotExist(err) {
+		t.Errorf("directory %s of cluster [%s] left behind", clusterDir, name)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	ctx := context.Background()
+	rt := runtimes.NewFake()
+	spec := testSpec()
+	spec.Publish = []string{"8080:80@server"}
+
+	cluster, err := Create(ctx, rt, spec)
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	defer Delete(ctx, rt, spec.Name)
+
+	if cluster.Name != "test" || cluster.Server.Names[0] != "/k3d-test-server" || len(cluster.Workers) != 2 {
+		t.Errorf("Create() = %+v, want cluster [test] with a server and 2 workers", cluster)
+	}
+	if !reflect.DeepEqual(rt.Images(), []string{"docker.io/rancher/k3s:v1"}) {
+		t.Errorf("images = %v, want the k3s image to be pulled", rt.Images())
+	}
+
+	nodes := []struct {
+		name      string
+		component string
+		ports     nat.PortMap
+	}{
+		{"k3d-test-server", "server", nat.PortMap{
+			"6550/tcp": {{HostIP: "0.0.0.0", HostPort: "6550"}},
+			"80/tcp":   {{HostPort: "8080"}},
+		}},
+		{"k3d-test-worker-0", "worker", nat.PortMap{}},
+		{"k3d-test-worker-1", "worker", nat.PortMap{}},
+	}
+	for _, node := range nodes {
+		c := rt.Container(node.name)
+		if c == nil {
+			t.Errorf("container %s wasn't created", node.name)
+			continue
+		}
+		if c.State != "running" {
+			t.Errorf("container %s is %s, want running", node.name, c.State)
+		}
+		for key, value := range map[string]string{"app": "k3d", "cluster": "test", "component": node.component} {
+			if c.Config.Labels[key] != value {
+				t.Errorf("container %s has label %s=%q, want %q", node.name, key, c.Config.Labels[key], value)
+			}
+		}
+		if len(c.HostConfig.PortBindings) != len(node.ports) || (len(node.ports) > 0 && !reflect.DeepEqual(c.HostConfig.PortBindings, node.ports)) {
+			t.Errorf("container %s has port bindings %v, want %v", node.name, c.HostConfig.PortBindings, node.ports)
+		}
+		if _, ok := c.NetworkingConfig.EndpointsConfig["k3d-test"]; !ok {
+			t.Errorf("container %s isn't attached to network k3d-test", node.name)
+		}
+	}
+
+	if _, err := Create(ctx, rt, spec); !errors.Is(err, ErrClusterExists) {
+		t.Errorf("Create() of an existing cluster = %v, want %v", err, ErrClusterExists)
+	}
+}
+
+func TestCreateRollback(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(rt *runtimes.Fake, spec *Spec)
+	}{
+		{"worker container name in use", func(rt *runtimes.Fake, spec *Spec) {
+			// a container that doesn't belong to any cluster, but has the name of the last worker
+			rt.PullImage(context.Background(), "docker.io/library/alpine:latest", ioutil.Discard)
+			if _, err := rt.CreateContainer(context.Background(), &container.Config{Image: "docker.io/library/alpine:latest"}, &container.HostConfig{}, &network.NetworkingConfig{}, "k3d-test-worker-1"); err != nil {
+				panic(err)
+			}
+		}},
+		{"importing images fails", func(rt *runtimes.Fake, spec *Spec) {
+			rt.PullImage(context.Background(), "myapp:dev", ioutil.Discard)
+			spec.ImportImages = []string{"myapp:dev"}
+			spec.ImageCache = true
+			rt.ExecFunc = func(c *runtimes.FakeContainer, cmd []string) (string, int, error) {
+				if strings.HasPrefix(strings.Join(cmd, " "), "ctr image import") {
+					return "ctr: image might be filtered out", 1, nil
+				}
+				return "", 0, nil
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rt := runtimes.NewFake()
+			spec := testSpec()
+			test.setup(rt, &spec)
+
+			if _, err := Create(context.Background(), rt, spec); err == nil {
+				t.Fatal("Create() succeeded, want an error")
+			}
+			assertNothingLeft(t, rt, spec.Name)
+		})
+	}
+}
+
+// noRestartRuntime is a runtime that doesn't restart containers, like podman
+type noRestartRuntime struct {
+	*runtimes.Fake
+}
+
+func (noRestartRuntime) SupportsRestartPolicy() bool {
+	return false
+}
+
+func TestCreateAutoRestartUnsupported(t *testing.T) {
+	rt := noRestartRuntime{runtimes.NewFake()}
+	spec := testSpec()
+	spec.AutoRestart = true
+
+	if _, err := Create(context.Background(), rt, spec); !errors.Is(err, ErrRestartPolicyUnsupported) {
+		t.Fatalf("Create() = %v, want %v", err, ErrRestartPolicyUnsupported)
+	}
+	assertNothingLeft(t, rt, spec.Name)
+
+	spec.AutoRestart = false
+	if _, err := Create(context.Background(), rt, spec); err != nil {
+		t.Fatalf("Create() without AutoRestart failed: %v", err)
+	}
+	Delete(context.Background(), rt, spec.Name)
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+	rt := runtimes.NewFake()
+	rt.PullImage(ctx, "myapp:dev", ioutil.Discard)
+	spec := testSpec()
+	// preloading images creates a preload volume in addition to the image volume
+	spec.ImportImages = []string{"myapp:dev"}
+
+	if _, err := Create(ctx, rt, spec); err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	if volumes, _ := rt.ListVolumes(ctx, map[string]string{"cluster": "test"}); len(volumes) != 2 {
+		t.Fatalf("Create() created volumes %v, want the image and the preload volume", volumes)
+	}
+
+	if err := Delete(ctx, rt, spec.Name); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+	assertNothingLeft(t, rt, spec.Name)
+
+	if err := Delete(ctx, rt, spec.Name); !errors.Is(err, ErrClusterNotFound) {
+		t.Errorf("Delete() of a deleted cluster = %v, want %v", err, ErrClusterNotFound)
+	}
+}
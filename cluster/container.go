@@ -0,0 +1,302 @@
+package cluster
+
+/*
+ * The functions in this file take care of spinning up the
+ * k3s server and worker containers as well as deleting them.
+ */
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/rancher/k3d/runtimes"
+	log "github.com/sirupsen/logrus"
+)
+
+// nodeSpec is the configuration shared by all nodes of a cluster. The NodeTo*Map fields hold the options
+// given by the user per node-specifier, see nodeArgs, nodeEnv and nodeVolumes.
+type nodeSpec struct {
+	AgentArgs   []string
+	APIPort     apiPort
+	AutoRestart bool
+	ClusterName string
+	Env         []string
+	HostCPUs    int
+	HostMemory  int64
+	Image       string
+	// Network is the name of the network that the nodes join
+	Network             string
+	NodeToAgentArgsMap  map[string][]string
+	NodeToArgsMap       map[string][]string
+	NodeToCPUsMap       map[string][]string
+	NodeToEnvMap        map[string][]string
+	NodeToIPMap         map[string][]string
+	NodeToMemoryMap     map[string][]string
+	NodeToPidsLimitMap  map[string][]string
+	NodeToPortSpecMap   map[string][]string
+	NodeToServerArgsMap map[string][]string
+	NodeToVolumesMap    map[string][]string
+	// Proxy collects the published ports of the nodes in an internal network (nil otherwise)
+	Proxy *proxySpec
+	// Pool is the name of the node pool that the worker nodes belong to (empty for the regular workers)
+	Pool           string
+	PortAutoOffset int
+	ServerArgs     []string
+	Verbose        bool
+	Volumes        []string
+}
+
+// startContainer creates and starts a container, pulling the image first if it's not available locally
+func startContainer(ctx context.Context, rt runtimes.Runtime, verbose bool, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (string, error) {
+	id, err := createContainer(ctx, rt, verbose, config, hostConfig, networkingConfig, containerName)
+	if err != nil {
+		return "", err
+	}
+
+	if err := rt.StartContainer(ctx, id); err != nil {
+		if isPortInUse(err) {
+			return "", &Error{Kind: ErrPortInUse, Message: fmt.Sprintf("couldn't start container %s, one of its published ports is already in use", containerName), Err: err}
+		}
+		return "", err
+	}
+
+	return id, nil
+}
+
+// createContainer creates (but doesn't start) a container, pulling the image first if it's not available locally
+func createContainer(ctx context.Context, rt runtimes.Runtime, verbose bool, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (string, error) {
+	id, err := rt.CreateContainer(ctx, config, hostConfig, networkingConfig, containerName)
+	if runtimes.IsErrNotFound(err) {
+		log.Infof("Pulling image %s...", config.Image)
+		// the pull progress is log output as well, so it mustn't end up on stdout
+		output := ioutil.Discard
+		if verbose {
+			output = os.Stderr
+		}
+		if err := rt.PullImage(ctx, config.Image, output); err != nil {
+			return "", fmt.Errorf("couldn't pull image %s\n%w", config.Image, err)
+		}
+		id, err = rt.CreateContainer(ctx, config, hostConfig, networkingConfig, containerName)
+		if err != nil {
+			return "", fmt.Errorf("couldn't create container after pull %s\n%w", containerName, err)
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("couldn't create container %s\n%w", containerName, err)
+	}
+
+	return id, nil
+}
+
+func createServer(ctx context.Context, rt runtimes.Runtime, spec *nodeSpec) (string, error) {
+	log.WithField("cluster", spec.ClusterName).Infof("Creating server using %s...", spec.Image)
+
+	containerLabels := make(map[string]string)
+	containerLabels["app"] = "k3d"
+	containerLabels["component"] = "server"
+	containerLabels["created"] = time.Now().Format("2006-01-02 15:04:05")
+	containerLabels["cluster"] = spec.ClusterName
+
+	containerName := GetContainerName("server", spec.ClusterName, -1)
+
+	// ports to be assigned to the server belong to roles
+	// all, server or <server-container-name>
+	serverPorts := spec.nodePorts("server", containerName)
+
+	hostIP := "0.0.0.0"
+	containerLabels["apihost"] = "localhost"
+	if spec.APIPort.Host != "" {
+		hostIP = spec.APIPort.HostIP
+		containerLabels["apihost"] = spec.APIPort.Host
+	}
+
+	apiPortSpec := fmt.Sprintf("%s:%s/tcp", net.JoinHostPort(hostIP, spec.APIPort.Port), spec.APIPort.Port)
+
+	serverPorts = append(serverPorts, apiPortSpec)
+
+	serverPublishedPorts, err := CreatePublishedPorts(serverPorts)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse port specs %+v\n%w", serverPorts, err)
+	}
+
+	hostConfig := &container.HostConfig{
+		PortBindings: serverPublishedPorts.PortBindings,
+		Privileged:   true,
+	}
+	if spec.Proxy != nil {
+		// the proxy publishes the ports instead
+		spec.Proxy.add(containerName, serverPublishedPorts)
+		hostConfig.PortBindings = nil
+	}
+
+	if spec.AutoRestart {
+		hostConfig.RestartPolicy.Name = "unless-stopped"
+	}
+
+	hostConfig.Binds = spec.nodeVolumes("server", containerName)
+
+	resources, err := spec.nodeResources("server", containerName)
+	if err != nil {
+		return "", err
+	}
+	hostConfig.Resources = resources.containerResources()
+	for key, value := range resources.labels() {
+		containerLabels[key] = value
+	}
+
+	networkingConfig := spec.nodeNetworkingConfig("server", containerName)
+
+	config := &container.Config{
+		Hostname:     containerName,
+		Image:        spec.Image,
+		Cmd:          append(append([]string{"server"}, resources.kubeletArgs(spec.HostCPUs, spec.HostMemory)...), spec.nodeArgs("server", containerName)...),
+		ExposedPorts: serverPublishedPorts.ExposedPorts,
+		Env:          spec.nodeEnv("server", containerName),
+		Labels:       containerLabels,
+	}
+	id, err := startContainer(ctx, rt, spec.Verbose, config, hostConfig, networkingConfig, containerName)
+	if err != nil {
+		return "", fmt.Errorf("couldn't create container %s\n%w", containerName, err)
+	}
+
+	return id, nil
+}
+
+// createWorker creates/starts a k3s agent node that connects to the server.
+// Workers of a node pool are named after the pool (k3d-<cluster>-<pool>-<postfix>). workerIndex numbers all workers
+// of the cluster (the ones of the node pools after the other ones), so that their port offsets don't collide.
+func createWorker(ctx context.Context, rt runtimes.Runtime, spec *nodeSpec, postfix, workerIndex int) (string, error) {
+	containerLabels := make(map[string]string)
+	containerLabels["app"] = "k3d"
+	containerLabels["component"] = "worker"
+	containerLabels["created"] = time.Now().Format("2006-01-02 15:04:05")
+	containerLabels["cluster"] = spec.ClusterName
+
+	containerName := GetContainerName("worker", spec.ClusterName, postfix)
+	if spec.Pool != "" {
+		containerLabels[PoolLabel] = spec.Pool
+		containerName = GetContainerName(spec.Pool, spec.ClusterName, postfix)
+	}
+
+	env := append(spec.nodeEnv("worker", containerName), fmt.Sprintf("K3S_URL=https://k3d-%s-server:%s", spec.ClusterName, spec.APIPort.Port))
+
+	// ports to be assigned to the server belong to roles
+	// all, server or <server-container-name>
+	workerPorts := spec.nodePorts("worker", containerName)
+	workerPublishedPorts, err := CreatePublishedPorts(workerPorts)
+	if err != nil {
+		return "", err
+	}
+	if spec.PortAutoOffset > 0 {
+		// TODO: add some checks before to print a meaningful log message saying that we cannot map multiple container ports
+		// to the same host port without a offset
+		workerPublishedPorts = workerPublishedPorts.Offset(workerIndex + spec.PortAutoOffset)
+	}
+
+	hostConfig := &container.HostConfig{
+		Tmpfs: map[string]string{
+			"/run":     "",
+			"/var/run": "",
+		},
+		PortBindings: workerPublishedPorts.PortBindings,
+		Privileged:   true,
+	}
+	if spec.Proxy != nil {
+		// the proxy publishes the ports instead
+		spec.Proxy.add(containerName, workerPublishedPorts)
+		hostConfig.PortBindings = nil
+	}
+
+	if spec.AutoRestart {
+		hostConfig.RestartPolicy.Name = "unless-stopped"
+	}
+
+	hostConfig.Binds = spec.nodeVolumes("worker", containerName)
+
+	resources, err := spec.nodeResources("worker", containerName)
+	if err != nil {
+		return "", err
+	}
+	hostConfig.Resources = resources.containerResources()
+	for key, value := range resources.labels() {
+		containerLabels[key] = value
+	}
+
+	networkingConfig := spec.nodeNetworkingConfig("worker", containerName)
+
+	config := &container.Config{
+		Hostname:     containerName,
+		Image:        spec.Image,
+		Env:          env,
+		Cmd:          append(append([]string{"agent"}, resources.kubeletArgs(spec.HostCPUs, spec.HostMemory)...), spec.nodeArgs("worker", containerName)...),
+		Labels:       containerLabels,
+		ExposedPorts: workerPublishedPorts.ExposedPorts,
+	}
+
+	id, err := startContainer(ctx, rt, spec.Verbose, config, hostConfig, networkingConfig, containerName)
+	if err != nil {
+		return "", fmt.Errorf("couldn't start container %s\n%w", containerName, err)
+	}
+
+	return id, nil
+}
+
+// removeContainer tries to rm a container, selected by Docker ID, and does a rm -f if it fails (e.g. if container is still running)
+func removeContainer(ctx context.Context, rt runtimes.Runtime, ID string) error {
+	if err := rt.RemoveContainer(ctx, ID); err != nil {
+		return fmt.Errorf("couldn't delete container [%s] -> %w", ID, err)
+	}
+	return nil
+}
+
+// executeInContainer runs a command inside of a running container and returns its (combined) output.
+// It returns an error including the output, if the command exits with a non-zero exit code.
+func executeInContainer(ctx context.Context, rt runtimes.Runtime, containerID string, cmd []string) (string, error) {
+	output, exitCode, err := rt.Exec(ctx, containerID, cmd)
+	if err != nil {
+		return "", err
+	}
+	if exitCode != 0 {
+		return output, fmt.Errorf("command %s failed in container [%s] with exit code %d:\n%s", cmd, containerID, exitCode, output)
+	}
+
+	return output, nil
+}
+
+// readFileFromContainer reads the contents of a single (regular) file in a container
+func readFileFromContainer(ctx context.Context, rt runtimes.Runtime, containerID, filePath string) ([]byte, error) {
+	reader, err := rt.CopyFromContainer(ctx, containerID, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't copy %s from container [%s]\n%w", filePath, containerID, err)
+	}
+	defer reader.Close()
+
+	// the docker API returns the file wrapped in a tar archive
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("file %s not found in container [%s]", filePath, containerID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read %s from container [%s]\n%w", filePath, containerID, err)
+		}
+		if header.Typeflag == tar.TypeReg && path.Base(header.Name) == path.Base(filePath) {
+			break
+		}
+	}
+
+	content, err := ioutil.ReadAll(tarReader)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read %s from container [%s]\n%w", filePath, containerID, err)
+	}
+	return content, nil
+}
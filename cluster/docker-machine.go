@@ -1,10 +1,11 @@
-package run
+package cluster
 
 import (
-	"log"
 	"os"
 	"os/exec"
 	"strings"
+
+	log "github.com/sirupsen/logrus"
 )
 
 func getDockerMachineIp() (string, error) {
@@ -21,10 +22,10 @@ func getDockerMachineIp() (string, error) {
 
 	out, err := exec.Command(dockerMachinePath, "ip", machine).Output()
 	if err != nil {
-		log.Printf("Error executing 'docker-machine ip'")
+		log.Error("Error executing 'docker-machine ip'")
 
 		if exitError, ok := err.(*exec.ExitError); ok {
-			log.Printf("%s", string(exitError.Stderr))
+			log.Error(string(exitError.Stderr))
 		}
 		return "", err
 	}
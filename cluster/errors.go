@@ -0,0 +1,78 @@
+package cluster
+
+/*
+ * The errors in this file allow callers to tell the reason of a failure apart using errors.Is,
+ * e.g. errors.Is(err, cluster.ErrClusterExists). The k3d CLI maps them to exit codes.
+ */
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/rancher/k3d/runtimes"
+)
+
+var (
+	// ErrClusterExists means that a cluster with the same name exists already
+	ErrClusterExists = errors.New("cluster already exists")
+	// ErrClusterNotFound means that the cluster doesn't exist
+	ErrClusterNotFound = errors.New("cluster does not exist")
+	// ErrPortInUse means that a port couldn't be published on the host, because it's used by something else
+	ErrPortInUse = errors.New("port is already in use")
+	// ErrTimeout means that the cluster wasn't up and running within the given timeout
+	ErrTimeout = errors.New("timeout exceeded")
+	// ErrRuntimeUnavailable means that the container runtime (e.g. the docker daemon) can't be reached
+	ErrRuntimeUnavailable = runtimes.ErrUnavailable
+	// ErrRestartPolicyUnsupported means that the container runtime (e.g. podman) can't restart the nodes (Spec.AutoRestart)
+	ErrRestartPolicyUnsupported = errors.New("restart policies are not supported by the container runtime")
+)
+
+// Error is an error of one of the categories above (Kind) with a message and the error that caused it (if any).
+// errors.Is matches both its Kind and the causing error, errors.As can be used to get the details.
+type Error struct {
+	Kind    error
+	Cluster string
+	Message string
+	Err     error
+}
+
+// Error returns the message followed by the causing error. It has no severity prefix, since the logger adds the level.
+func (e *Error) Error() string {
+	msg := e.Message
+	if e.Err != nil {
+		msg += "\n" + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the error that caused this one
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the error is of the given kind
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// contextError marks err as a timeout (ErrTimeout) or a cancellation (context.Canceled), if ctx is done.
+// The errors of the container runtime don't always wrap the context's error.
+func contextError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		if !errors.Is(err, ErrTimeout) {
+			return &Error{Kind: ErrTimeout, Message: "operation timed out", Err: err}
+		}
+	case context.Canceled:
+		if !errors.Is(err, context.Canceled) {
+			return &Error{Kind: context.Canceled, Message: "operation canceled", Err: err}
+		}
+	}
+	return err
+}
+
+// isPortInUse checks whether the runtime failed to start a container because one of its published ports is used already
+func isPortInUse(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "port is already allocated") || strings.Contains(err.Error(), "address already in use"))
+}
@@ -0,0 +1,32 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestError(t *testing.T) {
+	cause := errors.New("connection refused")
+	tests := []struct {
+		name string
+		err  error
+		want string
+		kind error
+	}{
+		{"without cause", &Error{Kind: ErrClusterNotFound, Message: "cluster [a] does not exist"}, "cluster [a] does not exist", ErrClusterNotFound},
+		{"with cause", &Error{Kind: ErrRuntimeUnavailable, Message: "couldn't list server containers", Err: cause}, "couldn't list server containers\nconnection refused", ErrRuntimeUnavailable},
+		{"wrapped", fmt.Errorf("Couldn't list clusters\n%w", &Error{Kind: ErrTimeout, Message: "operation timed out", Err: context.DeadlineExceeded}), "Couldn't list clusters\noperation timed out\ncontext deadline exceeded", ErrTimeout},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.err.Error(); got != test.want {
+				t.Errorf("Error() = %q, want %q", got, test.want)
+			}
+			if !errors.Is(test.err, test.kind) {
+				t.Errorf("errors.Is(%v, %v) = false", test.err, test.kind)
+			}
+		})
+	}
+}
@@ -0,0 +1,593 @@
+package cluster
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/rancher/k3d/runtimes"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	imageBasePathRemote = "/images"
+	k3dToolsImage       = "docker.io/iwilltry42/k3d-tools:v0.0.1"
+	// k3s imports all image tarballs found in this directory when the node (agent) starts
+	k3sAgentImagesDir = "/var/lib/rancher/k3s/agent/images"
+	// imageCacheVolumeName is the name of the docker volume shared by all clusters which use the image cache
+	imageCacheVolumeName = "k3d-image-cache"
+	// the image cache is mounted here (and not into k3s' agent images directory), so that the nodes only import the
+	// cached images requested for their cluster
+	imageCachePathRemote = "/images-cache"
+	// containerdTimeout is how long importing images into a node waits for containerd to come up
+	containerdTimeout = 2 * time.Minute
+	// imageCacheTempInfix marks tarballs which are still being written to the shared image cache
+	imageCacheTempInfix = ".tmp-"
+)
+
+// ImportImages saves the images from the local docker daemon and imports them into all nodes of the cluster.
+// The image tarball is kept in the cluster's image volume if noRemove is set.
+func ImportImages(ctx context.Context, rt runtimes.Runtime, clusterName string, images []string, noRemove bool) error {
+	// Get the container IDs for all containers in the cluster
+	clusters, err := getClusters(ctx, rt, false, clusterName)
+	if err != nil {
+		return fmt.Errorf("couldn't get cluster by name [%s]\n%w", clusterName, err)
+	}
+	if _, ok := clusters[clusterName]; !ok {
+		return &Error{Kind: ErrClusterNotFound, Cluster: clusterName, Message: fmt.Sprintf("cluster [%s] does not exist", clusterName)}
+	}
+	logger := log.WithField("cluster", clusterName)
+	containerList := []types.Container{clusters[clusterName].Server}
+	containerList = append(containerList, clusters[clusterName].Workers...)
+
+	// tarballs in the shared image cache are kept, so that other clusters can re-use them
+	if usesImageCache(clusters[clusterName].Server) {
+		cachedFileNames, err := saveImagesToCache(ctx, rt, clusterName, images)
+		if err != nil {
+			return err
+		}
+		if err := importCachedTarballs(ctx, rt, clusterName, containerList, images, cachedFileNames); err != nil {
+			return err
+		}
+		logger.Info("...Done")
+		return nil
+	}
+
+	//*** first, save the images using the local docker daemon
+	// get cluster directory to temporarily save the image tarball there
+	imageVolume, err := getImageVolume(ctx, rt, clusterName)
+	if err != nil {
+		return fmt.Errorf("couldn't get image volume for cluster [%s]\n%w", clusterName, err)
+	}
+
+	tarFileName := fmt.Sprintf("%s/k3d-%s-images-%s.tar", imageBasePathRemote, clusterName, time.Now().Format("20060102150405"))
+	if err := saveImages(ctx, rt, clusterName, imageVolume.Name, images, tarFileName); err != nil {
+		return err
+	}
+	tarFileNames := []string{tarFileName}
+
+	// *** second, import the images using ctr in the k3d nodes
+	if err := importTarballs(ctx, rt, clusterName, containerList, images, tarFileNames); err != nil {
+		return err
+	}
+
+	// remove tarball from inside the server container
+	if !noRemove {
+		logger.Info("Cleaning up tarball")
+
+		if _, err := executeInContainer(ctx, rt, clusters[clusterName].Server.ID, append([]string{"rm", "-f"}, tarFileNames...)); err != nil {
+			logger.Warnf("failed to delete tarball\n%+v", err)
+		} else {
+			logger.Info("deleted tarball")
+		}
+	}
+
+	logger.Info("...Done")
+
+	return nil
+}
+
+// importTarballs imports the image tarballs (paths inside the nodes) into every node using ctr.
+// Nodes which were just started may not run containerd yet, so it waits for containerd first.
+func importTarballs(ctx context.Context, rt runtimes.Runtime, clusterName string, nodes []types.Container, images, tarFileNames []string) error {
+	logger := log.WithField("cluster", clusterName)
+
+	// import in each node separately
+	// TODO: import concurrently using goroutines
+	for _, container := range nodes {
+
+		containerName := container.Names[0][1:] // trimming the leading "/" from name
+		if err := waitForContainerd(ctx, rt, container.ID); err != nil {
+			return fmt.Errorf("containerd isn't running in container [%s]\n%w", containerName, err)
+		}
+		logger.WithField("node", containerName).Infof("Importing images %s in container [%s]", images, containerName)
+
+		for _, tarFileName := range tarFileNames {
+			content, err := executeInContainer(ctx, rt, container.ID, []string{"ctr", "image", "import", tarFileName})
+			if err != nil {
+				return err
+			}
+
+			// example output "unpacking image........ ...done"
+			if !strings.Contains(content, "done") {
+				return fmt.Errorf("seems like something went wrong using `ctr image import` in container [%s]. Full output below:\n%s", containerName, content)
+			}
+		}
+	}
+
+	logger.Infof("Successfully imported images %s in all nodes of cluster [%s]", images, clusterName)
+	return nil
+}
+
+// importCachedTarballs imports the tarballs of the images (file names in the shared image cache) into the nodes.
+// A tarball which fails to import is removed from the cache, so that the image is saved again next time.
+func importCachedTarballs(ctx context.Context, rt runtimes.Runtime, clusterName string, nodes []types.Container, images, fileNames []string) error {
+	for i, fileName := range fileNames {
+		err := importTarballs(ctx, rt, clusterName, nodes, images[i:i+1], []string{path.Join(imageCachePathRemote, fileName)})
+		if err == nil {
+			continue
+		}
+		// a timeout or cancellation doesn't say anything about the tarball
+		if ctx.Err() == nil {
+			if err := removeFromImageCache(ctx, rt, clusterName, fileName); err != nil {
+				log.WithField("cluster", clusterName).Warnf("couldn't remove %s from the image cache\n%+v", fileName, err)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// waitForContainerd waits until ctr can talk to containerd in the node, but at most containerdTimeout
+func waitForContainerd(ctx context.Context, rt runtimes.Runtime, containerID string) error {
+	start := time.Now()
+	for {
+		_, err := executeInContainer(ctx, rt, containerID, []string{"ctr", "version"})
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(start.Add(containerdTimeout)) {
+			return err
+		}
+		if err := sleep(ctx, 1*time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+// imageCacheFileName returns the name of the tarball that holds the image in the shared image cache.
+// It contains the image ID, so that a rebuilt image (with the same reference) is cached again instead of
+// importing the stale tarball.
+func imageCacheFileName(image, id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return fmt.Sprintf("%s_%s.tar", strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(image), id)
+}
+
+// listImageCache returns the names of the image tarballs which are already present in the shared image cache.
+// It uses a created (but never started) tools container to read the contents of the cache volume.
+func listImageCache(ctx context.Context, rt runtimes.Runtime) (map[string]bool, error) {
+	containerConfig := container.Config{
+		Image: k3dToolsImage,
+		Labels: map[string]string{
+			"app":       "k3d",
+			"component": "tools",
+		},
+	}
+	hostConfig := container.HostConfig{
+		Binds: []string{fmt.Sprintf("%s:%s:ro", imageCacheVolumeName, imageBasePathRemote)},
+	}
+	toolsContainerID, err := createContainer(ctx, rt, false, &containerConfig, &hostConfig, &network.NetworkingConfig{}, "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		ctx, cancel := CleanupContext()
+		defer cancel()
+		if err := removeContainer(ctx, rt, toolsContainerID); err != nil {
+			log.Warnf("couldn't remove tools container\n%+v", err)
+		}
+	}()
+
+	reader, err := rt.CopyFromContainer(ctx, toolsContainerID, imageBasePathRemote+"/.")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read contents of the image cache\n%w", err)
+	}
+	defer reader.Close()
+
+	return readImageCacheListing(reader)
+}
+
+// readImageCacheListing returns the names of the complete tarballs in the tar archive of the image cache's contents.
+// Tarballs which are still being written (or whose save was interrupted) have a temporary name and are skipped.
+func readImageCacheListing(reader io.Reader) (map[string]bool, error) {
+	cached := make(map[string]bool)
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read contents of the image cache\n%w", err)
+		}
+		if name := path.Base(header.Name); header.Typeflag == tar.TypeReg && !strings.Contains(name, imageCacheTempInfix) {
+			cached[name] = true
+		}
+	}
+	return cached, nil
+}
+
+// saveImagesToCache saves every image which isn't cached yet as a separate tarball into the shared image cache.
+// It returns the file names of the tarballs for all requested images (relative to the cache volume).
+func saveImagesToCache(ctx context.Context, rt runtimes.Runtime, clusterName string, images []string) ([]string, error) {
+	cacheVolume, err := createImageCacheVolume(ctx, rt)
+	if err != nil {
+		return nil, err
+	}
+
+	cached, err := listImageCache(ctx, rt)
+	if err != nil {
+		return nil, err
+	}
+
+	tarFileNames := []string{}
+	for _, image := range images {
+		id, err := rt.ImageID(ctx, image)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get ID of image %s\n%w", image, err)
+		}
+		fileName := imageCacheFileName(image, id)
+		if cached[fileName] {
+			log.WithField("cluster", clusterName).Infof("Image %s found in shared image cache", image)
+		} else if err := saveImageToCache(ctx, rt, clusterName, cacheVolume.Name, image, fileName); err != nil {
+			return nil, err
+		}
+		tarFileNames = append(tarFileNames, fileName)
+	}
+	return tarFileNames, nil
+}
+
+// saveImageToCache saves the image into the shared image cache. Other clusters may use the cache at the same time,
+// so the tarball is written under a temporary name and only renamed to fileName once it is complete.
+func saveImageToCache(ctx context.Context, rt runtimes.Runtime, clusterName, volumeName, image, fileName string) error {
+	tempFileName := fileName + imageCacheTempInfix + GenerateRandomString(8)
+	if err := saveImages(ctx, rt, clusterName, volumeName, []string{image}, path.Join(imageBasePathRemote, tempFileName)); err != nil {
+		// don't leave a partial tarball behind, unless the save was canceled and nothing can be done anymore
+		if ctx.Err() == nil {
+			if err := removeFromImageCache(ctx, rt, clusterName, tempFileName); err != nil {
+				log.WithField("cluster", clusterName).Warnf("couldn't remove %s from the image cache\n%+v", tempFileName, err)
+			}
+		}
+		return err
+	}
+	return runToolsContainer(ctx, rt, clusterName, []string{"mv"}, []string{"-f", path.Join(imageBasePathRemote, tempFileName), path.Join(imageBasePathRemote, fileName)},
+		[]string{fmt.Sprintf("%s:%s:rw", volumeName, imageBasePathRemote)})
+}
+
+// removeFromImageCache removes a tarball from the shared image cache
+func removeFromImageCache(ctx context.Context, rt runtimes.Runtime, clusterName, fileName string) error {
+	return runToolsContainer(ctx, rt, clusterName, []string{"rm"}, []string{"-f", path.Join(imageBasePathRemote, fileName)},
+		[]string{fmt.Sprintf("%s:%s:rw", imageCacheVolumeName, imageBasePathRemote)})
+}
+
+// saveImages saves the given images from the local docker daemon as a tarball (tarFileName) into the image volume
+// by using a short-lived tools container
+func saveImages(ctx context.Context, rt runtimes.Runtime, clusterName, volumeName string, images []string, tarFileName string) error {
+	logger := log.WithField("cluster", clusterName)
+	logger.Infof("Saving images %s from local docker daemon...", images)
+	binds := []string{
+		fmt.Sprintf("%s:/var/run/docker.sock", rt.SocketPath()),
+		fmt.Sprintf("%s:%s:rw", volumeName, imageBasePathRemote),
+	}
+	if err := runToolsContainer(ctx, rt, clusterName, nil, append([]string{"save-image", "-d", tarFileName}, images...), binds); err != nil {
+		return err
+	}
+	logger.Info("saved images to shared docker volume")
+	return nil
+}
+
+// runToolsContainer runs the command in a short-lived tools container with the given binds and waits for it to exit.
+// Without entrypoint, the command is a command of the k3d tools (e.g. save-image).
+func runToolsContainer(ctx context.Context, rt runtimes.Runtime, clusterName string, entrypoint, cmd, binds []string) error {
+	logger := log.WithField("cluster", clusterName)
+	toolsContainerName := fmt.Sprintf("k3d-%s-tools", clusterName)
+
+	// create a tools container running the command on the bound volumes
+	containerConfig := container.Config{
+		Hostname: toolsContainerName,
+		Image:    k3dToolsImage,
+		Labels: map[string]string{
+			"app":       "k3d",
+			"cluster":   clusterName,
+			"component": "tools",
+		},
+		Entrypoint:   entrypoint,
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+	hostConfig := container.HostConfig{
+		Binds: binds,
+	}
+
+	toolsContainerID, err := startContainer(ctx, rt, false, &containerConfig, &hostConfig, &network.NetworkingConfig{}, toolsContainerName)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		ctx, cancel := CleanupContext()
+		defer cancel()
+		if err := rt.RemoveContainer(ctx, toolsContainerID); err != nil {
+			logger.Warnf("couldn't remove tools container\n%+v", err)
+		}
+	}()
+
+	// loop to wait for tools container to exit (failed or successfully ran the command)
+	for {
+		cont, err := rt.InspectContainer(ctx, toolsContainerID)
+		if err != nil {
+			return fmt.Errorf("couldn't get helper container's exit code\n%w", err)
+		}
+		if !cont.State.Running { // container finished...
+			if cont.State.ExitCode == 0 { // ...successfully
+				break
+			} else if cont.State.ExitCode != 0 { // ...failed
+				errTxt := fmt.Sprintf("helper container failed to run %s", append(entrypoint, cmd...))
+				logReader, err := rt.ContainerLogs(ctx, toolsContainerID)
+				if err != nil {
+					return fmt.Errorf("%s\n> couldn't get logs from helper container\n%w", errTxt, err)
+				}
+				logs, err := ioutil.ReadAll(logReader) // let's show somw logs indicating what happened
+				if err != nil {
+					return fmt.Errorf("%s\n> couldn't get logs from helper container\n%w", errTxt, err)
+				}
+				return fmt.Errorf("%s -> Logs from [%s]:\n>>>>>>\n%s\n<<<<<<", errTxt, toolsContainerName, string(logs))
+			}
+		}
+		// wait for half a second so we don't spam the docker API too much
+		if err := sleep(ctx, time.Second/2); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// nodeImage describes an image in the containerd image store of a k3d node as reported by `crictl images -o json`
+type nodeImage struct {
+	ID          string   `json:"id"`
+	RepoTags    []string `json:"repoTags"`
+	RepoDigests []string `json:"repoDigests"`
+	Size        string   `json:"size"`
+}
+
+// refs returns the references of the image: its tags or its digests, if it's not tagged
+func (i nodeImage) refs() []string {
+	if len(i.RepoTags) > 0 {
+		return i.RepoTags
+	}
+	if len(i.RepoDigests) > 0 {
+		return i.RepoDigests
+	}
+	return []string{i.ID}
+}
+
+// normalizeImageRef expands short image references the same way docker does, e.g. redis:6 -> docker.io/library/redis:6
+func normalizeImageRef(ref string) string {
+	if !strings.Contains(ref, "@") && !strings.Contains(ref[strings.LastIndex(ref, "/")+1:], ":") {
+		ref = ref + ":latest"
+	}
+	split := strings.SplitN(ref, "/", 2)
+	if len(split) == 1 {
+		return fmt.Sprintf("%s/library/%s", defaultRegistry, ref)
+	}
+	if !strings.ContainsAny(split[0], ".:") && split[0] != "localhost" {
+		return fmt.Sprintf("%s/%s", defaultRegistry, ref)
+	}
+	return ref
+}
+
+// getClusterNodes returns the server and worker containers of a cluster
+func getClusterNodes(ctx context.Context, rt runtimes.Runtime, clusterName string) ([]types.Container, error) {
+	clusters, err := getClusters(ctx, rt, false, clusterName)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get cluster by name [%s]\n%w", clusterName, err)
+	}
+	cluster, ok := clusters[clusterName]
+	if !ok {
+		return nil, &Error{Kind: ErrClusterNotFound, Cluster: clusterName, Message: fmt.Sprintf("cluster [%s] does not exist", clusterName)}
+	}
+	return append([]types.Container{cluster.Server}, cluster.Workers...), nil
+}
+
+// getNodeImages lists the images in the containerd image store of a k3d node
+func getNodeImages(ctx context.Context, rt runtimes.Runtime, node types.Container) ([]nodeImage, error) {
+	output, err := executeInContainer(ctx, rt, node.ID, []string{"crictl", "images", "-o", "json"})
+	if err != nil {
+		return nil, err
+	}
+
+	imageList := struct {
+		Images []nodeImage `json:"images"`
+	}{}
+	if err := json.Unmarshal([]byte(output), &imageList); err != nil {
+		return nil, fmt.Errorf("couldn't parse list of images in container [%s]\n%w", node.Names[0][1:], err)
+	}
+	return imageList.Images, nil
+}
+
+// Image describes an image in the containerd image store of the nodes of a cluster
+type Image struct {
+	Ref string
+	// Size in bytes
+	Size  int64
+	Nodes []string
+}
+
+// ListImages returns the images found in the nodes of a cluster (sorted by reference) together with their size and the nodes that have them
+func ListImages(ctx context.Context, rt runtimes.Runtime, clusterName string) ([]Image, error) {
+	nodes, err := getClusterNodes(ctx, rt, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	imagesByRef := make(map[string]*Image)
+	for _, node := range nodes {
+		images, err := getNodeImages(ctx, rt, node)
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range images {
+			for _, ref := range image.refs() {
+				if _, exists := imagesByRef[ref]; !exists {
+					size, _ := strconv.ParseInt(image.Size, 10, 64)
+					imagesByRef[ref] = &Image{Ref: ref, Size: size}
+				}
+				imagesByRef[ref].Nodes = append(imagesByRef[ref].Nodes, node.Names[0][1:])
+			}
+		}
+	}
+
+	images := make([]Image, 0, len(imagesByRef))
+	for _, image := range imagesByRef {
+		images = append(images, *image)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Ref < images[j].Ref })
+	return images, nil
+}
+
+// RemoveImages removes the images from all nodes of a cluster which have them
+func RemoveImages(ctx context.Context, rt runtimes.Runtime, clusterName string, images []string) error {
+	nodes, err := getClusterNodes(ctx, rt, clusterName)
+	if err != nil {
+		return err
+	}
+
+	removed := make(map[string]bool)
+	for _, node := range nodes {
+		nodeImages, err := getNodeImages(ctx, rt, node)
+		if err != nil {
+			return err
+		}
+		for _, image := range images {
+			ref := normalizeImageRef(image)
+			for _, nodeImage := range nodeImages {
+				if !containsString(nodeImage.refs(), ref) {
+					continue
+				}
+				log.WithFields(log.Fields{"cluster": clusterName, "node": node.Names[0][1:]}).Infof("Removing image %s from container [%s]", ref, node.Names[0][1:])
+				if _, err := executeInContainer(ctx, rt, node.ID, []string{"crictl", "rmi", ref}); err != nil {
+					return err
+				}
+				removed[image] = true
+			}
+		}
+	}
+
+	for _, image := range images {
+		if !removed[image] {
+			log.WithField("cluster", clusterName).Warnf("Image %s not found in any node of cluster [%s]", image, clusterName)
+		}
+	}
+
+	return nil
+}
+
+// ExportImage exports an image from a node of the cluster into a tarball at outputPath
+// or into the local docker daemon, if no outputPath is given
+func ExportImage(ctx context.Context, rt runtimes.Runtime, clusterName, image, outputPath string, verbose bool) error {
+	nodes, err := getClusterNodes(ctx, rt, clusterName)
+	if err != nil {
+		return err
+	}
+
+	// find a node which has the image
+	ref := normalizeImageRef(image)
+	var node *types.Container
+	for i := range nodes {
+		nodeImages, err := getNodeImages(ctx, rt, nodes[i])
+		if err != nil {
+			return err
+		}
+		for _, nodeImage := range nodeImages {
+			if containsString(nodeImage.refs(), ref) {
+				node = &nodes[i]
+				break
+			}
+		}
+		if node != nil {
+			break
+		}
+	}
+	if node == nil {
+		return fmt.Errorf("Image %s not found in any node of cluster [%s]", image, clusterName)
+	}
+
+	// export the image into the image volume using ctr in the node
+	nodeName := node.Names[0][1:]
+	tarFileName := fmt.Sprintf("%s/k3d-%s-export-%s.tar", imageBasePathRemote, clusterName, time.Now().Format("20060102150405"))
+	logger := log.WithFields(log.Fields{"cluster": clusterName, "node": nodeName})
+	logger.Infof("Exporting image %s from container [%s]", ref, nodeName)
+	if _, err := executeInContainer(ctx, rt, node.ID, []string{"ctr", "image", "export", tarFileName, ref}); err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := CleanupContext()
+		defer cancel()
+		if _, err := executeInContainer(ctx, rt, node.ID, []string{"rm", "-f", tarFileName}); err != nil {
+			logger.Warnf("failed to delete tarball %s in container [%s]\n%+v", tarFileName, nodeName, err)
+		}
+	}()
+
+	// copy the tarball out of the node
+	reader, err := rt.CopyFromContainer(ctx, node.ID, tarFileName)
+	if err != nil {
+		return fmt.Errorf("couldn't copy image tarball from container [%s]\n%w", nodeName, err)
+	}
+	defer reader.Close()
+
+	tarReader := tar.NewReader(reader)
+	if _, err := tarReader.Next(); err != nil {
+		return fmt.Errorf("couldn't read image tarball from container [%s]\n%w", nodeName, err)
+	}
+
+	if outputPath != "" {
+		outputFile, err := os.Create(outputPath)
+		if err != nil {
+			return fmt.Errorf("couldn't create file %s\n%w", outputPath, err)
+		}
+		defer outputFile.Close()
+		if _, err := io.Copy(outputFile, tarReader); err != nil {
+			return fmt.Errorf("couldn't write image tarball to %s\n%w", outputPath, err)
+		}
+		logger.Infof("Exported image %s to %s", ref, outputPath)
+		return nil
+	}
+
+	out := ioutil.Discard
+	if verbose {
+		out = os.Stderr
+	}
+	if err := rt.LoadImage(ctx, tarReader, out); err != nil {
+		return fmt.Errorf("couldn't load image %s into the local docker daemon\n%w", ref, err)
+	}
+	logger.Infof("Loaded image %s into the local docker daemon", ref)
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package cluster
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestImageCacheFileName(t *testing.T) {
+	tests := []struct {
+		image string
+		id    string
+		want  string
+	}{
+		{"myapp:dev", "sha256:ac7edb97166f0d2b2d3f4a8e", "myapp_dev_ac7edb97166f.tar"},
+		// a rebuilt image gets a new tarball
+		{"myapp:dev", "sha256:5f1c2e9a03b7aa12", "myapp_dev_5f1c2e9a03b7.tar"},
+		{"registry.local:5000/team/app:1.0", "sha256:0123456789abcdef", "registry.local_5000_team_app_1.0_0123456789ab.tar"},
+		{"redis@sha256:abcd", "sha256:fedcba987654", "redis_sha256_abcd_fedcba987654.tar"},
+		{"short:id", "1234", "short_id_1234.tar"},
+	}
+	for _, test := range tests {
+		t.Run(test.image, func(t *testing.T) {
+			if got := imageCacheFileName(test.image, test.id); got != test.want {
+				t.Errorf("imageCacheFileName(%q, %q) = %q, want %q", test.image, test.id, got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadImageCacheListing(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tarWriter := tar.NewWriter(buf)
+	files := []struct {
+		name     string
+		typeflag byte
+	}{
+		{"./", tar.TypeDir},
+		{"myapp_dev_ac7edb97166f.tar", tar.TypeReg},
+		// a save in progress (or an interrupted one) mustn't count as cached
+		{"redis_6_fedcba987654.tar.tmp-xKqPzLmA", tar.TypeReg},
+		{"nested/", tar.TypeDir},
+	}
+	for _, file := range files {
+		if err := tarWriter.WriteHeader(&tar.Header{Name: file.name, Typeflag: file.typeflag, Mode: 0644}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tarWriter.Close()
+
+	cached, err := readImageCacheListing(buf)
+	if want := map[string]bool{"myapp_dev_ac7edb97166f.tar": true}; err != nil || !reflect.DeepEqual(cached, want) {
+		t.Errorf("readImageCacheListing() = %v, %v, want %v", cached, err, want)
+	}
+}
@@ -0,0 +1,563 @@
+package cluster
+
+/*
+ * The functions in this file take care of merging the kubeconfig of k3d clusters
+ * into the kubeconfig files of the user (e.g. ~/.kube/config) and removing them again.
+ */
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/rancher/k3d/runtimes"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// mergedKubeConfigsFile is the file in the cluster directory that keeps track of the kubeconfig files that the cluster was merged into
+const mergedKubeConfigsFile = "merged-kubeconfigs"
+
+// kubeConfig is the subset of the kubeconfig format that k3d needs to know about.
+// All other fields are kept in the inline maps, so that we don't lose anything when we modify a user's kubeconfig.
+type kubeConfig struct {
+	APIVersion     string                 `yaml:"apiVersion,omitempty"`
+	Kind           string                 `yaml:"kind,omitempty"`
+	Clusters       []kubeConfigCluster    `yaml:"clusters"`
+	Contexts       []kubeConfigContext    `yaml:"contexts"`
+	Users          []kubeConfigUser       `yaml:"users"`
+	CurrentContext string                 `yaml:"current-context"`
+	Rest           map[string]interface{} `yaml:",inline"`
+}
+
+type kubeConfigCluster struct {
+	Name    string `yaml:"name"`
+	Cluster struct {
+		Server                   string                 `yaml:"server"`
+		CertificateAuthorityData string                 `yaml:"certificate-authority-data,omitempty"`
+		Rest                     map[string]interface{} `yaml:",inline"`
+	} `yaml:"cluster"`
+}
+
+type kubeConfigContext struct {
+	Name    string `yaml:"name"`
+	Context struct {
+		Cluster string                 `yaml:"cluster"`
+		User    string                 `yaml:"user"`
+		Rest    map[string]interface{} `yaml:",inline"`
+	} `yaml:"context"`
+}
+
+type kubeConfigUser struct {
+	Name string `yaml:"name"`
+	User struct {
+		ClientCertificateData string                 `yaml:"client-certificate-data,omitempty"`
+		ClientKeyData         string                 `yaml:"client-key-data,omitempty"`
+		Username              string                 `yaml:"username,omitempty"`
+		Password              string                 `yaml:"password,omitempty"`
+		Rest                  map[string]interface{} `yaml:",inline"`
+	} `yaml:"user"`
+}
+
+// kubeConfigContextName returns the name used for the cluster, user and context entries of a k3d cluster in a merged kubeconfig
+func kubeConfigContextName(cluster string) string {
+	return fmt.Sprintf("%s-%s", defaultContainerNamePrefix, cluster)
+}
+
+// readKubeConfig parses a kubeconfig file. A file which doesn't exist yet results in an empty kubeconfig.
+func readKubeConfig(path string) (*kubeConfig, error) {
+	config := &kubeConfig{
+		APIVersion: "v1",
+		Kind:       "Config",
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("couldn't read kubeconfig %s\n%w", path, err)
+	}
+
+	if err := yaml.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("couldn't parse kubeconfig %s\n%w", path, err)
+	}
+	return config, nil
+}
+
+// writeKubeConfig writes the kubeconfig to a file, creating the parent directories if required.
+// It writes a temporary file next to it first, which is renamed to the kubeconfig once it's complete,
+// so that other programs (e.g. kubectl) never read a partially written kubeconfig and a failure leaves the old one intact.
+func writeKubeConfig(path string, config *kubeConfig) error {
+	content, err := config.marshal()
+	if err != nil {
+		return err
+	}
+
+	// replace the file that a symlinked kubeconfig points to (which might not exist yet) instead of the symlink
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	} else if target, err := os.Readlink(path); err == nil {
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = target
+	}
+
+	if err := createDirIfNotExists(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("couldn't create directory for kubeconfig %s\n%w", path, err)
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("couldn't write kubeconfig %s\n%w", path, err)
+	}
+	defer os.Remove(tmpFile.Name()) // fails harmlessly after the rename
+
+	_, err = tmpFile.Write(content)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't write kubeconfig %s\n%w", path, err)
+	}
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return fmt.Errorf("couldn't write kubeconfig %s\n%w", path, err)
+	}
+	return nil
+}
+
+// rename sets the name of all cluster, user and context entries to 'name' and makes it the current context.
+// This is meant for the kubeconfig generated by k3s, which contains only entries named 'default'.
+func (c *kubeConfig) rename(name string) {
+	for i := range c.Clusters {
+		c.Clusters[i].Name = name
+	}
+	for i := range c.Users {
+		c.Users[i].Name = name
+	}
+	for i := range c.Contexts {
+		c.Contexts[i].Name = name
+		c.Contexts[i].Context.Cluster = name
+		c.Contexts[i].Context.User = name
+	}
+	c.CurrentContext = name
+}
+
+// merge adds all cluster, user and context entries of 'other' to the kubeconfig.
+// Existing entries with the same name are replaced.
+func (c *kubeConfig) merge(other *kubeConfig) {
+	for _, cluster := range other.Clusters {
+		c.removeCluster(cluster.Name)
+		c.Clusters = append(c.Clusters, cluster)
+	}
+	for _, user := range other.Users {
+		c.removeUser(user.Name)
+		c.Users = append(c.Users, user)
+	}
+	for _, context := range other.Contexts {
+		c.removeContext(context.Name)
+		c.Contexts = append(c.Contexts, context)
+	}
+}
+
+// remove deletes the cluster, user and context entries named 'name' and reports whether anything was changed
+func (c *kubeConfig) remove(name string) bool {
+	changed := c.removeCluster(name)
+	changed = c.removeUser(name) || changed
+	changed = c.removeContext(name) || changed
+	if c.CurrentContext == name {
+		c.CurrentContext = ""
+		changed = true
+	}
+	return changed
+}
+
+func (c *kubeConfig) removeCluster(name string) bool {
+	for i, cluster := range c.Clusters {
+		if cluster.Name == name {
+			c.Clusters = append(c.Clusters[:i], c.Clusters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *kubeConfig) removeUser(name string) bool {
+	for i, user := range c.Users {
+		if user.Name == name {
+			c.Users = append(c.Users[:i], c.Users[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *kubeConfig) removeContext(name string) bool {
+	for i, context := range c.Contexts {
+		if context.Name == name {
+			c.Contexts = append(c.Contexts[:i], c.Contexts[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// setServerHost points all clusters of the kubeconfig to the given host, keeping scheme and port of the server URLs
+func (c *kubeConfig) setServerHost(host string) error {
+	for i := range c.Clusters {
+		serverURL, err := url.Parse(c.Clusters[i].Cluster.Server)
+		if err != nil {
+			return fmt.Errorf("invalid server URL %s in kubeconfig\n%w", c.Clusters[i].Cluster.Server, err)
+		}
+		if port := serverURL.Port(); port != "" {
+			serverURL.Host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			serverURL.Host = "[" + host + "]" // IPv6 address without port
+		} else {
+			serverURL.Host = host
+		}
+		c.Clusters[i].Cluster.Server = serverURL.String()
+	}
+	return nil
+}
+
+// marshal serializes the kubeconfig
+func (c *kubeConfig) marshal() ([]byte, error) {
+	content, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't serialize kubeconfig\n%w", err)
+	}
+	return content, nil
+}
+
+// kubeConfigFiles returns the list of kubeconfig files in use, i.e. the files listed in $KUBECONFIG or ~/.kube/config
+func kubeConfigFiles() ([]string, error) {
+	files := []string{}
+	for _, file := range filepath.SplitList(os.Getenv("KUBECONFIG")) {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	if len(files) > 0 {
+		return files, nil
+	}
+
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get user's home directory\n%w", err)
+	}
+	return []string{path.Join(homeDir, ".kube", "config")}, nil
+}
+
+// kubeConfigDestination determines the kubeconfig file that new entries get written to.
+// Following kubectl's semantics for lists in $KUBECONFIG, this is the first file of the list that exists
+// or the last one if none of them exists. An explicitly chosen file always takes precedence.
+func kubeConfigDestination(explicitPath string) (string, error) {
+	if explicitPath != "" {
+		return explicitPath, nil
+	}
+
+	files, err := kubeConfigFiles()
+	if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		}
+	}
+	return files[len(files)-1], nil
+}
+
+// MergeKubeConfig merges the kubeconfig of a cluster into the user's kubeconfig, naming all entries k3d-<cluster>.
+// Following kubectl's semantics for lists in $KUBECONFIG, this is the first file of the list that exists (or the last one
+// if none of them exists) unless explicitPath is set. It returns the path of the kubeconfig file that was written.
+func MergeKubeConfig(ctx context.Context, rt runtimes.Runtime, cluster, explicitPath string, switchContext, overwrite bool) (string, error) {
+	clusterKubeConfigPath, err := KubeConfigPath(ctx, rt, cluster, overwrite, false)
+	if err != nil {
+		return "", err
+	}
+	clusterKubeConfig, err := readKubeConfig(clusterKubeConfigPath)
+	if err != nil {
+		return "", err
+	}
+	clusterKubeConfig.rename(kubeConfigContextName(cluster))
+
+	destPath, err := kubeConfigDestination(explicitPath)
+	if err != nil {
+		return "", err
+	}
+	destKubeConfig, err := readKubeConfig(destPath)
+	if err != nil {
+		return "", err
+	}
+
+	destKubeConfig.merge(clusterKubeConfig)
+	if switchContext {
+		destKubeConfig.CurrentContext = kubeConfigContextName(cluster)
+	}
+
+	if err := writeKubeConfig(destPath, destKubeConfig); err != nil {
+		return "", err
+	}
+
+	// remember where we merged the cluster into, so that we can clean up when the cluster gets deleted
+	if err := trackMergedKubeConfig(cluster, destPath); err != nil {
+		log.WithField("cluster", cluster).Warnf("couldn't keep track of merged kubeconfig %s\n%+v", destPath, err)
+	}
+
+	return destPath, nil
+}
+
+// trackMergedKubeConfig records a kubeconfig file that the cluster was merged into in the cluster directory
+func trackMergedKubeConfig(cluster, kubeConfigPath string) error {
+	tracked, err := getMergedKubeConfigs(cluster)
+	if err != nil {
+		return err
+	}
+	absPath, err := filepath.Abs(kubeConfigPath)
+	if err != nil {
+		return err
+	}
+	if containsString(tracked, absPath) {
+		return nil
+	}
+
+	clusterDir, err := getClusterDir(cluster)
+	if err != nil {
+		return err
+	}
+	tracked = append(tracked, absPath)
+	return ioutil.WriteFile(path.Join(clusterDir, mergedKubeConfigsFile), []byte(strings.Join(tracked, "\n")+"\n"), 0600)
+}
+
+// getMergedKubeConfigs returns the kubeconfig files that the cluster was merged into
+func getMergedKubeConfigs(cluster string) ([]string, error) {
+	clusterDir, err := getClusterDir(cluster)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(path.Join(clusterDir, mergedKubeConfigsFile))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(content)), nil
+}
+
+// removeKubeConfigEntries removes the k3d-<cluster> entries from all kubeconfig files that the cluster was merged into
+// and from the kubeconfig files currently in use
+func removeKubeConfigEntries(cluster string) error {
+	files, err := getMergedKubeConfigs(cluster)
+	if err != nil {
+		return err
+	}
+	defaultFiles, err := kubeConfigFiles()
+	if err != nil {
+		return err
+	}
+	for _, file := range defaultFiles {
+		if absPath, err := filepath.Abs(file); err == nil && !containsString(files, absPath) {
+			files = append(files, absPath)
+		}
+	}
+
+	for _, file := range files {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			continue
+		}
+		config, err := readKubeConfig(file)
+		if err != nil {
+			return err
+		}
+		if !config.remove(kubeConfigContextName(cluster)) {
+			continue
+		}
+		if err := writeKubeConfig(file, config); err != nil {
+			return err
+		}
+		log.WithField("cluster", cluster).Infof("...Removed cluster [%s] from kubeconfig %s", cluster, file)
+	}
+	return nil
+}
+
+// SwitchKubeConfigContext makes k3d-<cluster> the current context of the user's kubeconfig,
+// if the cluster was merged into it. It reports whether the context was switched.
+func SwitchKubeConfigContext(cluster string) (bool, error) {
+	kubeConfigPath, err := kubeConfigDestination("")
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(kubeConfigPath); os.IsNotExist(err) {
+		return false, nil
+	}
+	config, err := readKubeConfig(kubeConfigPath)
+	if err != nil {
+		return false, err
+	}
+
+	contextName := kubeConfigContextName(cluster)
+	for _, context := range config.Contexts {
+		if context.Name == contextName {
+			config.CurrentContext = contextName
+			return true, writeKubeConfig(kubeConfigPath, config)
+		}
+	}
+	return false, nil
+}
+
+// getClusterKubeConfigPath returns the path of the cluster's kubeconfig file in the cluster directory.
+// The in-network kubeconfig (see fetchKubeConfig) is kept in a separate file.
+func getClusterKubeConfigPath(cluster string, internal bool) (string, error) {
+	clusterDir, err := getClusterDir(cluster)
+	if internal {
+		return path.Join(clusterDir, "kubeconfig-internal.yaml"), err
+	}
+	return path.Join(clusterDir, "kubeconfig.yaml"), err
+}
+
+// fetchKubeConfig gets the kubeconfig generated by k3s from the server container of the cluster
+// and points it to the host that the API server is published on.
+// If internal is set, it points to the server container instead, so that it can be used
+// by other containers attached to the cluster network.
+func fetchKubeConfig(ctx context.Context, rt runtimes.Runtime, cluster string, internal bool) (*kubeConfig, error) {
+	server, err := rt.ListContainers(ctx, map[string]string{"app": "k3d", "cluster": cluster, "component": "server"}, false)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get server container for cluster %s\n%w", cluster, err)
+	}
+
+	if len(server) == 0 {
+		return nil, fmt.Errorf("No server container for cluster %s", cluster)
+	}
+
+	// get kubeconfig file from container and read contents
+	readBytes, err := readFileFromContainer(ctx, rt, server[0].ID, "/output/kubeconfig.yaml")
+	if err != nil {
+		return nil, err
+	}
+
+	config := &kubeConfig{}
+	if err := yaml.Unmarshal(readBytes, config); err != nil {
+		return nil, fmt.Errorf("couldn't parse kubeconfig of cluster %s\n%w", cluster, err)
+	}
+
+	// Fix up kubeconfig.yaml file.
+	//
+	// K3s generates the default kubeconfig.yaml with host name as 'localhost'.
+	// Change the host name to the name user specified via the --api-port argument.
+	//
+	// When user did not specify the host name and when we are running against a remote docker,
+	// set the host name to remote docker machine's IP address.
+	//
+	// Otherwise, the hostname remains as 'localhost'
+	apiHost := server[0].Labels["apihost"]
+	if apiHost == "" {
+		apiHost = "localhost"
+	}
+	if internal {
+		// the API server listens on the same port inside the container and the server container's name is in its TLS SANs
+		apiHost = GetContainerName("server", cluster, -1)
+	}
+	if err := config.setServerHost(apiHost); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// isKubeConfigStale checks whether a cached kubeconfig doesn't match the current one of the cluster anymore,
+// e.g. because the cluster was re-created with new certificates or a different API port
+func isKubeConfigStale(cached, current *kubeConfig) bool {
+	if len(cached.Clusters) == 0 || len(current.Clusters) == 0 {
+		return true
+	}
+	return cached.Clusters[0].Cluster.Server != current.Clusters[0].Cluster.Server ||
+		cached.Clusters[0].Cluster.CertificateAuthorityData != current.Clusters[0].Cluster.CertificateAuthorityData
+}
+
+// KubeConfigPath returns the path to the kubeconfig file of the cluster in the cluster directory.
+// The file is (re-)generated if it doesn't exist yet, if it's stale or if overwrite is set.
+// If internal is set, the kubeconfig points to the server container for use in the cluster network.
+func KubeConfigPath(ctx context.Context, rt runtimes.Runtime, cluster string, overwrite, internal bool) (string, error) {
+	kubeConfigPath, err := getClusterKubeConfigPath(cluster, internal)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := Get(ctx, rt, cluster); err != nil {
+		return "", err
+	}
+
+	current, err := fetchKubeConfig(ctx, rt, cluster, internal)
+	if err != nil {
+		return "", err
+	}
+
+	// keep the cached kubeconfig.yaml (which the user might have modified) as long as it's still valid
+	if _, err := os.Stat(kubeConfigPath); err == nil && !overwrite {
+		cached, err := readKubeConfig(kubeConfigPath)
+		if err == nil && !isKubeConfigStale(cached, current) {
+			return kubeConfigPath, nil
+		}
+		log.WithField("cluster", cluster).Infof("Cached kubeconfig for cluster [%s] is outdated, regenerating it", cluster)
+	} else if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	// writeKubeConfig also creates the cluster directory, which might be missing,
+	// e.g. if the cluster was created by another user or from another machine
+	if err := writeKubeConfig(kubeConfigPath, current); err != nil {
+		return "", err
+	}
+
+	return kubeConfigPath, nil
+}
+
+// buildKubeConfig returns the kubeconfig of a single cluster or, for multiple clusters, one kubeconfig
+// containing all of them with their entries named k3d-<cluster> and the first one as current context
+func buildKubeConfig(ctx context.Context, rt runtimes.Runtime, clusters []string, internal bool) (*kubeConfig, error) {
+	if len(clusters) == 1 {
+		return fetchKubeConfig(ctx, rt, clusters[0], internal)
+	}
+
+	config := &kubeConfig{
+		APIVersion: "v1",
+		Kind:       "Config",
+	}
+	for _, cluster := range clusters {
+		clusterConfig, err := fetchKubeConfig(ctx, rt, cluster, internal)
+		if err != nil {
+			return nil, err
+		}
+		clusterConfig.rename(kubeConfigContextName(cluster))
+		config.merge(clusterConfig)
+		if config.CurrentContext == "" {
+			config.CurrentContext = clusterConfig.CurrentContext
+		}
+	}
+	return config, nil
+}
+
+// KubeConfig returns the kubeconfig of the cluster (pointing to the host that the API server is published on
+// or, if internal is set, to the server container)
+func KubeConfig(ctx context.Context, rt runtimes.Runtime, cluster string, internal bool) ([]byte, error) {
+	return KubeConfigs(ctx, rt, []string{cluster}, internal)
+}
+
+// KubeConfigs returns one kubeconfig for multiple clusters with their entries named k3d-<cluster>
+// and the first one as current context
+func KubeConfigs(ctx context.Context, rt runtimes.Runtime, clusters []string, internal bool) ([]byte, error) {
+	config, err := buildKubeConfig(ctx, rt, clusters, internal)
+	if err != nil {
+		return nil, err
+	}
+	return config.marshal()
+}
@@ -0,0 +1,228 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// k3sKubeConfig is a kubeconfig like the one generated by k3s
+const k3sKubeConfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: default
+  cluster:
+    server: https://127.0.0.1:6443
+    certificate-authority-data: Y2E=
+contexts:
+- name: default
+  context:
+    cluster: default
+    user: default
+current-context: default
+users:
+- name: default
+  user:
+    username: admin
+    password: secret
+`
+
+// userKubeConfig is a kubeconfig of the user with fields that k3d doesn't know about
+const userKubeConfig = `apiVersion: v1
+kind: Config
+preferences:
+  colors: true
+clusters:
+- name: prod
+  cluster:
+    server: https://prod.example.com
+    insecure-skip-tls-verify: true
+contexts:
+- name: prod
+  context:
+    cluster: prod
+    user: prod
+    namespace: web
+current-context: prod
+users:
+- name: prod
+  user:
+    token: abc
+`
+
+func parseKubeConfig(t *testing.T, content string) *kubeConfig {
+	t.Helper()
+	config := &kubeConfig{}
+	if err := yaml.Unmarshal([]byte(content), config); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestKubeConfigRename(t *testing.T) {
+	config := parseKubeConfig(t, k3sKubeConfig)
+	config.rename("k3d-a")
+
+	context := config.Contexts[0]
+	if config.Clusters[0].Name != "k3d-a" || config.Users[0].Name != "k3d-a" || context.Name != "k3d-a" ||
+		context.Context.Cluster != "k3d-a" || context.Context.User != "k3d-a" || config.CurrentContext != "k3d-a" {
+		t.Errorf("rename() = %+v, want all entries and the current context named k3d-a", config)
+	}
+}
+
+func TestKubeConfigMergeRemove(t *testing.T) {
+	config := parseKubeConfig(t, userKubeConfig)
+	original, err := config.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster := parseKubeConfig(t, k3sKubeConfig)
+	cluster.rename("k3d-a")
+	config.merge(cluster)
+
+	// merging again (e.g. after the cluster was re-created) replaces the entries
+	recreated := parseKubeConfig(t, strings.Replace(k3sKubeConfig, "6443", "6444", 1))
+	recreated.rename("k3d-a")
+	config.merge(recreated)
+
+	if len(config.Clusters) != 2 || len(config.Users) != 2 || len(config.Contexts) != 2 {
+		t.Fatalf("merge() = %+v, want the entries of prod and k3d-a", config)
+	}
+	if server := config.Clusters[1].Cluster.Server; server != "https://127.0.0.1:6444" {
+		t.Errorf("merged server = %s, want the one merged last", server)
+	}
+	if config.CurrentContext != "prod" {
+		t.Errorf("merge() switched the current context to %s", config.CurrentContext)
+	}
+
+	if !config.remove("k3d-a") {
+		t.Error("remove() = false, want true")
+	}
+	if config.remove("k3d-a") {
+		t.Error("remove() of removed entries = true, want false")
+	}
+	removed, err := config.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(removed) != string(original) {
+		t.Errorf("kubeconfig after merge() and remove() =\n%s\nwant\n%s", removed, original)
+	}
+}
+
+func TestKubeConfigRemoveCurrentContext(t *testing.T) {
+	config := parseKubeConfig(t, k3sKubeConfig)
+	config.rename("k3d-a")
+	if !config.remove("k3d-a") || config.CurrentContext != "" || len(config.Clusters)+len(config.Users)+len(config.Contexts) != 0 {
+		t.Errorf("remove() = %+v, want an empty kubeconfig without current context", config)
+	}
+}
+
+func TestKubeConfigSetServerHost(t *testing.T) {
+	tests := []struct {
+		server string
+		host   string
+		want   string
+	}{
+		{"https://127.0.0.1:6443", "localhost", "https://localhost:6443"},
+		{"https://127.0.0.1:6443", "::1", "https://[::1]:6443"},
+		{"https://[::1]:6443", "192.168.99.100", "https://192.168.99.100:6443"},
+		{"https://127.0.0.1", "fd00::1", "https://[fd00::1]"},
+		{"https://127.0.0.1", "k3d-a-server", "https://k3d-a-server"},
+	}
+	for _, test := range tests {
+		config := parseKubeConfig(t, strings.Replace(k3sKubeConfig, "https://127.0.0.1:6443", test.server, 1))
+		if err := config.setServerHost(test.host); err != nil {
+			t.Errorf("setServerHost(%s) on %s failed: %v", test.host, test.server, err)
+		} else if got := config.Clusters[0].Cluster.Server; got != test.want {
+			t.Errorf("setServerHost(%s) on %s = %s, want %s", test.host, test.server, got, test.want)
+		}
+	}
+}
+
+func TestKubeConfigDestination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k3d-kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	existing := filepath.Join(dir, "existing")
+	if err := ioutil.WriteFile(existing, []byte(userKubeConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	missing1, missing2 := filepath.Join(dir, "missing1"), filepath.Join(dir, "missing2")
+	list := func(files ...string) string {
+		return strings.Join(files, string(filepath.ListSeparator))
+	}
+	defer os.Unsetenv("KUBECONFIG")
+
+	tests := []struct {
+		name       string
+		kubeconfig string
+		explicit   string
+		wantFiles  []string
+		want       string
+	}{
+		{"default", "", "", []string{filepath.Join(os.Getenv("HOME"), ".kube", "config")}, filepath.Join(os.Getenv("HOME"), ".kube", "config")},
+		{"first existing", list(missing1, existing, missing2), "", []string{missing1, existing, missing2}, existing},
+		{"last if none exists", list(missing1, missing2), "", []string{missing1, missing2}, missing2},
+		{"empty entries", list("", missing1, ""), "", []string{missing1}, missing1},
+		{"explicit", list(existing), missing1, []string{existing}, missing1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv("KUBECONFIG", test.kubeconfig)
+
+			files, err := kubeConfigFiles()
+			if err != nil || !reflect.DeepEqual(files, test.wantFiles) {
+				t.Errorf("kubeConfigFiles() = %v, %v, want %v", files, err, test.wantFiles)
+			}
+			if got, err := kubeConfigDestination(test.explicit); err != nil || got != test.want {
+				t.Errorf("kubeConfigDestination(%q) = %s, %v, want %s", test.explicit, got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestWriteKubeConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k3d-kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "kube", "config")
+	link := filepath.Join(dir, "config-link")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first write creates the directory, the second one replaces the file
+	for _, content := range []string{userKubeConfig, k3sKubeConfig} {
+		if err := writeKubeConfig(link, parseKubeConfig(t, content)); err != nil {
+			t.Fatalf("writeKubeConfig() failed: %v", err)
+		}
+	}
+
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("symlinked kubeconfig was replaced: %v, %v", info, err)
+	}
+	if info, err := os.Stat(target); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("kubeconfig %s = %v, %v, want a file only readable by the user", target, info, err)
+	}
+	written, err := readKubeConfig(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(written, parseKubeConfig(t, k3sKubeConfig)) {
+		t.Errorf("readKubeConfig() = %+v, want the kubeconfig written last", written)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Dir(target)); len(files) != 1 {
+		t.Errorf("files next to the kubeconfig = %v, want no temporary files", files)
+	}
+}
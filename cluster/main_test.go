@@ -0,0 +1,25 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TestMain points $HOME to a temporary directory, since creating and deleting clusters
+// writes to ~/.config/k3d and ~/.kube/config
+func TestMain(m *testing.M) {
+	home, err := ioutil.TempDir("", "k3d-test-home")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("HOME", home)
+	os.Unsetenv("KUBECONFIG")
+	log.SetOutput(ioutil.Discard)
+
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
@@ -0,0 +1,296 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/rancher/k3d/runtimes"
+	log "github.com/sirupsen/logrus"
+)
+
+// networks of docker which don't support the aliases that the nodes use to reach each other
+var unsupportedNetworks = []string{"bridge", "host", "none"}
+
+// IP ranges of the pods and services in clusters with IPv6 (k3s' defaults for IPv4 are 10.42.0.0/16 and 10.43.0.0/16)
+const (
+	defaultIPv4ClusterCIDR = "10.42.0.0/16"
+	defaultIPv4ServiceCIDR = "10.43.0.0/16"
+	defaultIPv6ClusterCIDR = "fd42::/56"
+	defaultIPv6ServiceCIDR = "fd43::/112"
+)
+
+func k3dNetworkName(clusterName string) string {
+	return fmt.Sprintf("k3d-%s", clusterName)
+}
+
+// ipv6Enabled checks whether the nodes of the cluster get IPv6 addresses (IPv6 only or dual-stack)
+func (spec Spec) ipv6Enabled() bool {
+	return spec.IPv6 || spec.DualStack
+}
+
+// isIPv6CIDR checks whether cidr is an IPv6 subnet
+func isIPv6CIDR(cidr string) bool {
+	ip, _, err := net.ParseCIDR(cidr)
+	return err == nil && ip.To4() == nil
+}
+
+// defaultIPv6Subnet returns the IPv6 subnet of a cluster network without user-configured IPv6 subnet, since docker
+// doesn't choose one by default. It's a unique local /64 subnet derived from the cluster name.
+func defaultIPv6Subnet(clusterName string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(clusterName))
+	sum := hash.Sum32()
+	return fmt.Sprintf("fd6b:3364:%04x:%04x::/64", sum>>16, sum&0xffff)
+}
+
+// networkIPAM returns the IP address management of the network created for the cluster (nil: chosen by docker)
+func (spec Spec) networkIPAM() *network.IPAM {
+	configs := []network.IPAMConfig{}
+	if spec.Subnet != "" {
+		configs = append(configs, network.IPAMConfig{Subnet: spec.Subnet, Gateway: spec.Gateway, IPRange: spec.IPRange})
+	}
+	if spec.ipv6Enabled() && !isIPv6CIDR(spec.Subnet) {
+		configs = append(configs, network.IPAMConfig{Subnet: defaultIPv6Subnet(spec.Name)})
+	}
+	if len(configs) == 0 {
+		return nil
+	}
+	return &network.IPAM{Config: configs}
+}
+
+// ipFamilyServerArgs returns the k3s server arguments with the IP ranges of the pods and services
+// for IPv6 only or dual-stack clusters, unless they are set by the user
+func (spec Spec) ipFamilyServerArgs() []string {
+	clusterCIDR, serviceCIDR := defaultIPv6ClusterCIDR, defaultIPv6ServiceCIDR
+	if spec.DualStack {
+		// k3s expects the IPv4 ranges first
+		clusterCIDR = defaultIPv4ClusterCIDR + "," + clusterCIDR
+		serviceCIDR = defaultIPv4ServiceCIDR + "," + serviceCIDR
+	} else if !spec.IPv6 {
+		return []string{}
+	}
+	args := []string{}
+	if !hasArg(spec.ServerArgs, "--cluster-cidr") {
+		args = append(args, "--cluster-cidr", clusterCIDR)
+	}
+	if !hasArg(spec.ServerArgs, "--service-cidr") {
+		args = append(args, "--service-cidr", serviceCIDR)
+	}
+	return args
+}
+
+// hasArg checks whether one of the arguments (with or without node-specifiers) sets the flag
+func hasArg(args []string, flag string) bool {
+	for _, arg := range args {
+		if _, arg = extractNodes(arg, ""); arg == flag || strings.HasPrefix(arg, flag+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// validateNetworkSpec checks the network options of the spec and the static IPs of the nodes (nodeNames are the names
+// of all nodes of the cluster) before anything is created
+func validateNetworkSpec(spec Spec, nodeNames []string) error {
+	if spec.Network != "" {
+		if containsString(unsupportedNetworks, spec.Network) {
+			return fmt.Errorf("The nodes can't join docker's [%s] network, please use a user-defined network", spec.Network)
+		}
+		if spec.Subnet != "" || spec.Gateway != "" || spec.IPRange != "" {
+			return fmt.Errorf("The subnet, gateway and IP range can only be set for networks created by k3d, not for the existing network [%s]", spec.Network)
+		}
+	}
+	if spec.NetworkInternal && spec.Network != "" {
+		return fmt.Errorf("--network-internal only applies to networks created by k3d, not to the existing network [%s]", spec.Network)
+	}
+	if spec.IPv6 && spec.DualStack {
+		return fmt.Errorf("--ipv6 (IPv6 only) and --dual-stack (IPv4 and IPv6) can't be combined")
+	}
+	if isIPv6CIDR(spec.Subnet) && !spec.ipv6Enabled() {
+		return fmt.Errorf("The IPv6 subnet [%s] requires --ipv6 or --dual-stack", spec.Subnet)
+	}
+
+	var subnet *net.IPNet
+	if spec.Subnet != "" {
+		var err error
+		if _, subnet, err = net.ParseCIDR(spec.Subnet); err != nil {
+			return fmt.Errorf("Invalid subnet [%s]\n%w", spec.Subnet, err)
+		}
+	} else if spec.Gateway != "" || spec.IPRange != "" {
+		return fmt.Errorf("The gateway and IP range of the network require a subnet")
+	}
+	if spec.Gateway != "" {
+		if gateway := net.ParseIP(spec.Gateway); gateway == nil || !subnet.Contains(gateway) {
+			return fmt.Errorf("Invalid gateway [%s] (has to be an IP of the subnet %s)", spec.Gateway, spec.Subnet)
+		}
+	}
+	if spec.IPRange != "" {
+		if ip, _, err := net.ParseCIDR(spec.IPRange); err != nil || !subnet.Contains(ip) {
+			return fmt.Errorf("Invalid IP range [%s] (has to be a CIDR within the subnet %s)", spec.IPRange, spec.Subnet)
+		}
+	}
+
+	subnets := []*net.IPNet{}
+	if ipam := spec.networkIPAM(); ipam != nil && spec.Network == "" {
+		for _, config := range ipam.Config {
+			_, subnet, _ := net.ParseCIDR(config.Subnet)
+			subnets = append(subnets, subnet)
+		}
+	}
+	return validateStaticIPs(spec.IPs, nodeNames, subnets, spec.Network != "")
+}
+
+// validateStaticIPs checks the static IPs, which need a node-specifier selecting a single node (server, master or a
+// node name). Docker only allows static IPs in networks with a configured subnet (existingNetwork can't be checked).
+func validateStaticIPs(ips []string, nodeNames []string, subnets []*net.IPNet, existingNetwork bool) error {
+	if len(ips) > 0 && len(subnets) == 0 && !existingNetwork {
+		return fmt.Errorf("Static IPs require a subnet for the network (or an existing network with a configured subnet)")
+	}
+	assigned, assignedNodes := []string{}, []string{}
+	for _, spec := range ips {
+		if err := validateNodeSpecifiers([]string{spec}, "static IP"); err != nil {
+			return err
+		}
+		nodes, ipSpec := extractNodes(spec, "")
+		ip := net.ParseIP(ipSpec)
+		if ip == nil {
+			return fmt.Errorf("Invalid static IP [%s]", spec)
+		}
+		if !existingNetwork && !subnetsContain(subnets, ip) {
+			return fmt.Errorf("Static IP [%s] isn't part of the subnets %s of the network", spec, subnets)
+		}
+		for _, node := range nodes {
+			if node != "server" && node != "master" && !containsString(nodeNames, node) {
+				return fmt.Errorf("Static IP [%s] needs a node-specifier selecting a single node (server or a node name)", spec)
+			}
+		}
+		if len(nodes) != 1 || containsString(assigned, ipSpec) {
+			return fmt.Errorf("Static IP [%s] can only be assigned to a single node", spec)
+		}
+		node := nodes[0]
+		if node == "master" {
+			node = "server"
+		}
+		if containsString(assignedNodes, node) {
+			return fmt.Errorf("Node [%s] can only have a single static IP", nodes[0])
+		}
+		assigned, assignedNodes = append(assigned, ipSpec), append(assignedNodes, node)
+	}
+	return nil
+}
+
+// subnetsContain checks whether one of the subnets contains the IP
+func subnetsContain(subnets []*net.IPNet, ip net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setupClusterNetwork returns the name of the network that the nodes join: the existing network given with
+// spec.Network (which k3d neither labels nor deletes) or the network that k3d creates for the cluster
+func setupClusterNetwork(ctx context.Context, rt runtimes.Runtime, spec Spec) (string, error) {
+	logger := log.WithField("cluster", spec.Name)
+	if spec.Network == "" {
+		networkID, err := createClusterNetwork(ctx, rt, spec.Name, spec.networkIPAM(), spec.ipv6Enabled(), spec.NetworkInternal)
+		if err != nil {
+			return "", err
+		}
+		logger.Debugf("Created cluster network with ID %s", networkID)
+		return k3dNetworkName(spec.Name), nil
+	}
+
+	networks, err := rt.ListNetworks(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("Failed to list networks\n%w", err)
+	}
+	for _, network := range networks {
+		if network.Name == spec.Network || network.ID == spec.Network {
+			if spec.ipv6Enabled() && !network.EnableIPv6 {
+				return "", fmt.Errorf("Network [%s] doesn't have IPv6 enabled", network.Name)
+			}
+			logger.Infof("Using existing network [%s]", network.Name)
+			return network.Name, nil
+		}
+	}
+	return "", fmt.Errorf("Network [%s] doesn't exist", spec.Network)
+}
+
+// nodeNetworkingConfig connects a node to the cluster network with its name as alias and its static IP, if any
+func (spec *nodeSpec) nodeNetworkingConfig(role, name string) *network.NetworkingConfig {
+	endpoint := &network.EndpointSettings{
+		Aliases: []string{name},
+	}
+	if ip := net.ParseIP(lastNodeSpec(spec.NodeToIPMap, spec.nodeGroups(role), name)); ip != nil {
+		endpoint.IPAMConfig = &network.EndpointIPAMConfig{}
+		if ip.To4() != nil {
+			endpoint.IPAMConfig.IPv4Address = ip.String()
+		} else {
+			endpoint.IPAMConfig.IPv6Address = ip.String()
+		}
+	}
+	return &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			spec.Network: endpoint,
+		},
+	}
+}
+
+// createClusterNetwork creates a docker network for a cluster that will be used
+// to let the server and worker containers communicate with each other easily.
+// ipam is optional (docker chooses a free IPv4 subnet by default), IPv6 requires an IPv6 subnet in ipam.
+// An internal network has no access to the outside.
+func createClusterNetwork(ctx context.Context, rt runtimes.Runtime, clusterName string, ipam *network.IPAM, enableIPv6, internal bool) (string, error) {
+	nl, err := rt.ListNetworks(ctx, map[string]string{"app": "k3d", "cluster": clusterName})
+	if err != nil {
+		return "", fmt.Errorf("Failed to list networks\n%w", err)
+	}
+
+	if len(nl) > 1 {
+		log.WithField("cluster", clusterName).Warnf("Found %d networks for %s when we only expect 1", len(nl), clusterName)
+	}
+
+	if len(nl) > 0 {
+		return nl[0].ID, nil
+	}
+
+	// create the network with a set of labels and the cluster name as network name
+	id, err := rt.CreateNetwork(ctx, k3dNetworkName(clusterName), types.NetworkCreate{
+		Labels: map[string]string{
+			"app":     "k3d",
+			"cluster": clusterName,
+		},
+		IPAM:       ipam,
+		EnableIPv6: enableIPv6,
+		Internal:   internal,
+	})
+	if err != nil {
+		return "", fmt.Errorf("couldn't create network\n%w", err)
+	}
+
+	return id, nil
+}
+
+// deleteClusterNetwork deletes a docker network based on the name of a cluster it belongs to
+func deleteClusterNetwork(ctx context.Context, rt runtimes.Runtime, clusterName string) error {
+	networks, err := rt.ListNetworks(ctx, map[string]string{"app": "k3d", "cluster": clusterName})
+	if err != nil {
+		return fmt.Errorf("couldn't find network for cluster %s\n%w", clusterName, err)
+	}
+
+	// there should be only one network that matches the name... but who knows?
+	for _, network := range networks {
+		if err := rt.RemoveNetwork(ctx, network.ID); err != nil {
+			log.WithField("cluster", clusterName).Warnf("couldn't remove network\n%+v", err)
+			continue
+		}
+	}
+	return nil
+}
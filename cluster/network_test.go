@@ -0,0 +1,240 @@
+package cluster
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/rancher/k3d/runtimes"
+)
+
+func TestValidateStaticIPs(t *testing.T) {
+	nodes := []string{"k3d-test-server", "k3d-test-worker-0", "k3d-test-worker-1"}
+	_, subnet, _ := net.ParseCIDR("172.28.0.0/16")
+	_, subnetIPv6, _ := net.ParseCIDR("fd00:28::/64")
+	subnets := []*net.IPNet{subnet}
+	tests := []struct {
+		name            string
+		ips             []string
+		subnets         []*net.IPNet
+		existingNetwork bool
+		wantErr         bool
+	}{
+		{"single nodes", []string{"172.28.0.10@server", "172.28.0.20@k3d-test-worker-0"}, subnets, false, false},
+		{"master is the server", []string{"172.28.0.10@master"}, subnets, false, false},
+		{"IPv6", []string{"fd00:28::10@server"}, []*net.IPNet{subnet, subnetIPv6}, false, false},
+		{"IPv6 outside of the subnets", []string{"fd00:29::10@server"}, []*net.IPNet{subnet, subnetIPv6}, false, true},
+		// the subnet of an existing network isn't known
+		{"existing network", []string{"10.0.0.10@server"}, nil, true, false},
+		{"no subnet", []string{"172.28.0.10@server"}, nil, false, true},
+		{"outside of the subnet", []string{"172.29.0.10@server"}, subnets, false, true},
+		{"invalid IP", []string{"172.28.0.300@server"}, subnets, false, true},
+		// a static IP can't be shared, so it has to select exactly one node
+		{"without node-specifier", []string{"172.28.0.10"}, subnets, false, true},
+		{"several nodes", []string{"172.28.0.10@workers"}, subnets, false, true},
+		{"unknown node", []string{"172.28.0.10@k3d-test-worker-2"}, subnets, false, true},
+		{"two node-specifiers", []string{"172.28.0.10@server@k3d-test-worker-0"}, subnets, false, true},
+		{"IP assigned twice", []string{"172.28.0.10@server", "172.28.0.10@k3d-test-worker-0"}, subnets, false, true},
+		{"two IPs for a node", []string{"172.28.0.10@server", "172.28.0.11@master"}, subnets, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := validateStaticIPs(test.ips, nodes, test.subnets, test.existingNetwork); (err != nil) != test.wantErr {
+				t.Errorf("validateStaticIPs(%v) = %v, want error: %t", test.ips, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateNetworkSpec(t *testing.T) {
+	nodes := []string{"k3d-test-server", "k3d-test-worker-0"}
+	invalid := map[string]Spec{
+		"docker's bridge network":        {Network: "bridge"},
+		"subnet of an existing network":  {Network: "my-net", Subnet: "172.28.0.0/16"},
+		"invalid subnet":                 {Subnet: "172.28.0.0"},
+		"gateway without subnet":         {Gateway: "172.28.0.1"},
+		"gateway outside of the subnet":  {Subnet: "172.28.0.0/16", Gateway: "172.29.0.1"},
+		"IP range outside of the subnet": {Subnet: "172.28.0.0/16", IPRange: "172.29.5.0/24"},
+	}
+	for name, spec := range invalid {
+		spec.Name = "test"
+		if err := validateNetworkSpec(spec, nodes); err == nil {
+			t.Errorf("%s: validateNetworkSpec(%+v) succeeded, want an error", name, spec)
+		}
+	}
+}
+
+func TestCreateWithStaticIPs(t *testing.T) {
+	ctx := context.Background()
+	rt := runtimes.NewFake()
+	spec := Spec{
+		Name:    "ips",
+		Image:   "rancher/k3s:v1",
+		APIPort: "6550",
+		Workers: 2,
+		Subnet:  "172.28.0.0/16",
+		Gateway: "172.28.0.1",
+		IPs:     []string{"172.28.0.10@server", "172.28.0.20@k3d-ips-worker-1"},
+	}
+	if _, err := Create(ctx, rt, spec); err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	defer Delete(ctx, rt, spec.Name)
+
+	networks, _ := rt.ListNetworks(ctx, map[string]string{"cluster": "ips"})
+	if len(networks) != 1 || len(networks[0].IPAM.Config) != 1 || networks[0].IPAM.Config[0].Subnet != spec.Subnet || networks[0].IPAM.Config[0].Gateway != spec.Gateway {
+		t.Fatalf("Create() created networks %+v, want k3d-ips with subnet %s", networks, spec.Subnet)
+	}
+
+	for node, ip := range map[string]string{"k3d-ips-server": "172.28.0.10", "k3d-ips-worker-0": "", "k3d-ips-worker-1": "172.28.0.20"} {
+		endpoint := rt.Container(node).NetworkingConfig.EndpointsConfig["k3d-ips"]
+		if endpoint == nil {
+			t.Errorf("%s isn't attached to network k3d-ips", node)
+			continue
+		}
+		got := ""
+		if endpoint.IPAMConfig != nil {
+			got = endpoint.IPAMConfig.IPv4Address
+		}
+		if got != ip {
+			t.Errorf("%s has the static IP %q, want %q", node, got, ip)
+		}
+	}
+}
+
+func TestCreateInExistingNetwork(t *testing.T) {
+	ctx := context.Background()
+	rt := runtimes.NewFake()
+	if _, err := rt.CreateNetwork(ctx, "shared", types.NetworkCreate{}); err != nil {
+		t.Fatal(err)
+	}
+	spec := Spec{Name: "joined", Image: "rancher/k3s:v1", APIPort: "6550", Workers: 1, Network: "shared"}
+
+	if _, err := Create(ctx, rt, spec); err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	for _, node := range []string{"k3d-joined-server", "k3d-joined-worker-0"} {
+		if _, ok := rt.Container(node).NetworkingConfig.EndpointsConfig["shared"]; !ok {
+			t.Errorf("%s isn't attached to network shared", node)
+		}
+	}
+	if networks, _ := rt.ListNetworks(ctx, nil); len(networks) != 1 {
+		t.Errorf("networks = %+v, want only the existing network", networks)
+	}
+
+	// the network belongs to the user, so deleting the cluster keeps it
+	if err := Delete(ctx, rt, spec.Name); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+	if networks, _ := rt.ListNetworks(ctx, nil); len(networks) != 1 || networks[0].Name != "shared" {
+		t.Errorf("networks after Delete() = %+v, want network shared to be kept", networks)
+	}
+
+	spec.Network = "missing"
+	if _, err := Create(ctx, rt, spec); err == nil {
+		t.Error("Create() in a missing network succeeded, want an error")
+	}
+}
+
+func TestDefaultIPv6Subnet(t *testing.T) {
+	subnets := map[string]string{}
+	for _, name := range []string{"test", "k3s-default", "dev", "staging"} {
+		subnet := defaultIPv6Subnet(name)
+		ip, ipNet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			t.Fatalf("defaultIPv6Subnet(%q) = %q, which isn't a subnet: %v", name, subnet, err)
+		}
+		if ones, _ := ipNet.Mask.Size(); ip.To4() != nil || ones != 64 || ip[0] != 0xfd {
+			t.Errorf("defaultIPv6Subnet(%q) = %q, want a unique local IPv6 /64 subnet", name, subnet)
+		}
+		// clusters side by side need their own subnets
+		if other, ok := subnets[subnet]; ok {
+			t.Errorf("clusters [%s] and [%s] get the same subnet %s", other, name, subnet)
+		}
+		subnets[subnet] = name
+	}
+}
+
+func TestValidateIPFamilies(t *testing.T) {
+	// e.g. fd6b:3364:...::10 in the subnet fd6b:3364:...::/64
+	ipInDefaultSubnet := strings.TrimSuffix(defaultIPv6Subnet("test"), "/64") + "10"
+	tests := []struct {
+		name    string
+		spec    Spec
+		wantErr bool
+	}{
+		{"IPv6", Spec{IPv6: true}, false},
+		{"dual-stack", Spec{DualStack: true, Subnet: "172.28.0.0/16"}, false},
+		{"static IP in the default IPv6 subnet", Spec{IPv6: true, IPs: []string{ipInDefaultSubnet + "@server"}}, false},
+		{"IPv6 and dual-stack", Spec{IPv6: true, DualStack: true}, true},
+		{"IPv6 subnet without IPv6", Spec{Subnet: "fd00:28::/64"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.spec.Name = "test"
+			if err := validateNetworkSpec(test.spec, []string{"k3d-test-server"}); (err != nil) != test.wantErr {
+				t.Errorf("validateNetworkSpec(%+v) = %v, want error: %t", test.spec, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestCreateWithIPv6(t *testing.T) {
+	tests := []struct {
+		name        string
+		spec        Spec
+		subnets     []string
+		clusterCIDR string
+		serviceCIDR string
+	}{
+		{"IPv6", Spec{IPv6: true}, []string{defaultIPv6Subnet("v6")}, "fd42::/56", "fd43::/112"},
+		{"dual-stack", Spec{DualStack: true, Subnet: "172.28.0.0/16"}, []string{"172.28.0.0/16", defaultIPv6Subnet("v6")},
+			"10.42.0.0/16,fd42::/56", "10.43.0.0/16,fd43::/112"},
+		// the ranges given by the user replace the defaults instead of being passed twice
+		{"user-defined cluster CIDR", Spec{IPv6: true, Subnet: "fd00:28::/64", ServerArgs: []string{"--cluster-cidr=fd99::/56@server"}},
+			[]string{"fd00:28::/64"}, "", "fd43::/112"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			rt := runtimes.NewFake()
+			spec := test.spec
+			spec.Name, spec.Image, spec.APIPort = "v6", "rancher/k3s:v1", "[::1]:6443"
+
+			if _, err := Create(ctx, rt, spec); err != nil {
+				t.Fatalf("Create() failed: %v", err)
+			}
+			defer Delete(ctx, rt, spec.Name)
+
+			networks, _ := rt.ListNetworks(ctx, map[string]string{"cluster": "v6"})
+			if len(networks) != 1 || !networks[0].EnableIPv6 {
+				t.Fatalf("Create() created networks %+v, want an IPv6-enabled network", networks)
+			}
+			subnets := []string{}
+			for _, config := range networks[0].IPAM.Config {
+				subnets = append(subnets, config.Subnet)
+			}
+			if !reflect.DeepEqual(subnets, test.subnets) {
+				t.Errorf("network has subnets %v, want %v", subnets, test.subnets)
+			}
+
+			server := rt.Container("k3d-v6-server")
+			cmd := strings.Join(server.Config.Cmd, " ")
+			if strings.Count(cmd, "--cluster-cidr") != 1 || (test.clusterCIDR != "" && !strings.Contains(cmd, "--cluster-cidr "+test.clusterCIDR)) {
+				t.Errorf("server has command %q, want the cluster CIDR %s once", cmd, test.clusterCIDR)
+			}
+			if !strings.Contains(cmd, "--service-cidr "+test.serviceCIDR) {
+				t.Errorf("server has command %q, want the service CIDR %s", cmd, test.serviceCIDR)
+			}
+			if !strings.Contains(cmd, "--tls-san ::1") {
+				t.Errorf("server has command %q, want a TLS SAN for ::1", cmd)
+			}
+			if bindings := server.HostConfig.PortBindings["6443/tcp"]; len(bindings) != 1 || bindings[0].HostIP != "::1" {
+				t.Errorf("server publishes the API port at %v, want [::1]:6443", bindings)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package cluster
+
+/*
+ * This file contains the handling of node-specifiers (e.g. `@workers` or `@k3d-mycluster-worker-0`), which select the
+ * nodes that an option (e.g. a published port or a node label) applies to
+ */
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mapping a node role to groups that should be applied to it
+var nodeRuleGroupsMap = map[string][]string{
+	"worker": {"all", "workers"},
+	"server": {"all", "server", "master"},
+}
+
+// taintEffects are the effects that a node taint can have
+var taintEffects = []string{"NoSchedule", "PreferNoSchedule", "NoExecute"}
+
+// mapNodesToSpecs maps the node-specifiers (roles or node names) to the specs that apply to them. Specs without
+// node-specifier apply to defaultNode. Unknown node-specifiers are skipped with a warning mentioning the kind of spec.
+func mapNodesToSpecs(specs []string, createdNodes []string, defaultNode, kind string) map[string][]string {
+
+	// check node-specifier possibilitites
+	possibleNodeSpecifiers := getPossibleNodeSpecifiers(createdNodes)
+
+	nodeToSpecMap := make(map[string][]string)
+
+	for _, spec := range specs {
+		if spec == "" {
+			continue
+		}
+		nodes, nodeSpec := extractNodes(spec, defaultNode)
+
+		for _, node := range nodes {
+			// check if node-specifier is valid (either a role or a name) and append to list if matches
+			if !containsString(possibleNodeSpecifiers, node) {
+				log.Warnf("Unknown node-specifier [%s] in %s entry [%s]", node, kind, spec)
+				continue
+			}
+			nodeToSpecMap[node] = append(nodeToSpecMap[node], nodeSpec)
+		}
+	}
+
+	return nodeToSpecMap
+}
+
+// getPossibleNodeSpecifiers returns the roles and the names of the nodes (and node pools) that can be selected
+func getPossibleNodeSpecifiers(createdNodes []string) []string {
+	return append([]string{"all", "workers", "server", "master"}, createdNodes...)
+}
+
+// mapNodesToValueSpecs is mapNodesToSpecs for specs whose values may contain `@` themselves (e.g. environment
+// variables or a datastore endpoint with credentials). Only trailing node-specifiers selecting a role or one of the
+// createdNodes are split off (see splitNodeSpecifiers), everything else is kept verbatim as part of the value.
+// A spec ending with something that could be a node name, but isn't a known one, is rejected as a mistyped
+// node-specifier (see validateValueSpecs).
+func mapNodesToValueSpecs(specs []string, createdNodes []string, defaultNode, kind string) (map[string][]string, error) {
+	if err := validateValueSpecs(specs, createdNodes, kind); err != nil {
+		return nil, err
+	}
+	possibleNodeSpecifiers := getPossibleNodeSpecifiers(createdNodes)
+
+	nodeToSpecMap := make(map[string][]string)
+	for _, spec := range specs {
+		if spec == "" {
+			continue
+		}
+		nodes, value := splitNodeSpecifiers(spec, possibleNodeSpecifiers, defaultNode)
+		for _, node := range nodes {
+			nodeToSpecMap[node] = append(nodeToSpecMap[node], value)
+		}
+	}
+	return nodeToSpecMap, nil
+}
+
+// validateValueSpecs checks the specs of mapNodesToValueSpecs: if no node-specifier was split off, the part after
+// the last `@` has to be something that can't be a node name (e.g. foo@example.com or user:pass@db:5432/k3s).
+// Values ending with `@<host name>` can still be given by appending a node-specifier (e.g. A=user@devbox@all).
+func validateValueSpecs(specs []string, createdNodes []string, kind string) error {
+	possibleNodeSpecifiers := getPossibleNodeSpecifiers(createdNodes)
+	for _, spec := range specs {
+		if _, value := splitNodeSpecifiers(spec, possibleNodeSpecifiers, ""); value == spec {
+			if last := strings.LastIndex(spec, "@"); last >= 0 && ValidateHostname(spec[last+1:]) == nil {
+				if err := validateNodeSpecifier(spec[last+1:], spec, kind, possibleNodeSpecifiers); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateNodeSpecifier checks a node-specifier of the spec, which has to select a role, a node pool or a node
+func validateNodeSpecifier(node, spec, kind string, possibleNodeSpecifiers []string) error {
+	if err := ValidateHostname(node); err != nil {
+		return fmt.Errorf("Invalid node-specifier [%s] in %s [%s]\n%w", node, kind, spec, err)
+	}
+	if !containsString(possibleNodeSpecifiers, node) {
+		return fmt.Errorf("Unknown node-specifier [%s] in %s [%s] (known: %s)", node, kind, spec, strings.Join(possibleNodeSpecifiers, ", "))
+	}
+	return nil
+}
+
+// splitNodeSpecifiers splits the trailing node-specifiers off the spec, as long as they are possible node-specifiers.
+// The rest is the value, which is the whole spec (selecting defaultNode) if it doesn't end with a node-specifier.
+func splitNodeSpecifiers(spec string, possibleNodeSpecifiers []string, defaultNode string) ([]string, string) {
+	nodes := []string{}
+	value := spec
+	for {
+		last := strings.LastIndex(value, "@")
+		if last < 0 || !containsString(possibleNodeSpecifiers, value[last+1:]) {
+			break
+		}
+		nodes = append([]string{value[last+1:]}, nodes...)
+		value = value[:last]
+	}
+	if len(nodes) == 0 {
+		return []string{defaultNode}, spec
+	}
+	return nodes, value
+}
+
+// extractNodes separates the node-specifiers from the actual spec
+func extractNodes(spec, defaultNode string) ([]string, string) {
+	atSplit := strings.Split(spec, "@")
+	if len(atSplit) > 1 {
+		return atSplit[1:], atSplit[0]
+	}
+	return []string{defaultNode}, atSplit[0]
+}
+
+// mergeNodeSpecs returns the specs for a given node, which are selected by one of its groups (e.g. its role)
+// or its name (without duplicates). The specs are ordered from the least to the most specific node-specifier.
+func mergeNodeSpecs(nodeToSpecMap map[string][]string, groups []string, name string) []string {
+	specs := []string{}
+	for _, group := range append(append([]string{}, groups...), name) {
+		for _, spec := range nodeToSpecMap[group] {
+			if !containsString(specs, spec) {
+				specs = append(specs, spec)
+			}
+		}
+	}
+	return specs
+}
+
+// mapNodesToRoleSpecs is mapNodesToValueSpecs for specs that only apply to the nodes of one role (e.g. k3s agent
+// arguments). roleNodes are the names of these nodes out of the createdNodes. Node-specifiers that don't select any
+// of them are skipped with a warning.
+func mapNodesToRoleSpecs(specs []string, createdNodes, roleNodes []string, role, defaultNode, kind string) (map[string][]string, error) {
+	nodeToSpecMap, err := mapNodesToValueSpecs(specs, createdNodes, defaultNode, kind)
+	if err != nil {
+		return nil, err
+	}
+	for node := range nodeToSpecMap {
+		if !containsString(nodeRuleGroupsMap[role], node) && !containsString(roleNodes, node) {
+			log.Warnf("Node-specifier [%s] doesn't select any %s node, skipping %s entries %s", node, role, kind, nodeToSpecMap[node])
+			delete(nodeToSpecMap, node)
+		}
+	}
+	return nodeToSpecMap, nil
+}
+
+// nodeGroups returns the groups (node-specifiers) that a node of the given role belongs to from the least to the most
+// specific one: the groups of its role (see nodeRuleGroupsMap) and its node pool, if any
+func (spec *nodeSpec) nodeGroups(role string) []string {
+	groups := append([]string{}, nodeRuleGroupsMap[role]...)
+	if spec.Pool != "" {
+		groups = append(groups, spec.Pool)
+	}
+	return groups
+}
+
+// nodeArgs returns the k3s arguments of a node: the ones shared by all nodes of its role
+// followed by the server or agent arguments, labels and taints selected by node-specifiers
+func (spec *nodeSpec) nodeArgs(role, name string) []string {
+	args := []string{}
+	if role == "server" {
+		args = append(args, spec.ServerArgs...)
+		args = append(args, mergeNodeSpecs(spec.NodeToServerArgsMap, spec.nodeGroups(role), name)...)
+	} else {
+		args = append(args, spec.AgentArgs...)
+		args = append(args, mergeNodeSpecs(spec.NodeToAgentArgsMap, spec.nodeGroups(role), name)...)
+	}
+	return append(args, mergeNodeSpecs(spec.NodeToArgsMap, spec.nodeGroups(role), name)...)
+}
+
+// nodeEnv returns the environment variables of a node: the ones shared by all nodes followed by the selected ones
+func (spec *nodeSpec) nodeEnv(role, name string) []string {
+	return append(append([]string{}, spec.Env...), mergeNodeSpecs(spec.NodeToEnvMap, spec.nodeGroups(role), name)...)
+}
+
+// nodeVolumes returns the volumes mounted into a node: the selected ones followed by the ones shared by all nodes
+func (spec *nodeSpec) nodeVolumes(role, name string) []string {
+	return append(mergeNodeSpecs(spec.NodeToVolumesMap, spec.nodeGroups(role), name), spec.Volumes...)
+}
+
+// validateNodeSpecifiers checks the node-specifiers of the specs, which have to be valid host names
+func validateNodeSpecifiers(specs []string, kind string) error {
+	for _, spec := range specs {
+		for _, node := range strings.Split(spec, "@")[1:] {
+			if err := ValidateHostname(node); err != nil {
+				return fmt.Errorf("Invalid node-specifier [%s] in %s [%s]\n%w", node, kind, spec, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateNodeLabel checks a node label (Format: key=value)
+func validateNodeLabel(label string) error {
+	if !strings.Contains(label, "=") || strings.HasPrefix(label, "=") {
+		return fmt.Errorf("Invalid node label [%s] (Format: key=value)", label)
+	}
+	return nil
+}
+
+// validateNodeTaint checks a node taint (Format: key[=value]:effect)
+func validateNodeTaint(taint string) error {
+	colon := strings.LastIndex(taint, ":")
+	if colon <= 0 || strings.HasPrefix(taint, "=") {
+		return fmt.Errorf("Invalid node taint [%s] (Format: key=value:effect)", taint)
+	}
+	if effect := taint[colon+1:]; !containsString(taintEffects, effect) {
+		return fmt.Errorf("Invalid effect [%s] of node taint [%s] (supported: %s)", effect, taint, strings.Join(taintEffects, ", "))
+	}
+	return nil
+}
+
+// mapNodesToNodeArgs translates the node labels and taints into the k3s arguments (--node-label and --node-taint)
+// of the nodes selected by their node-specifiers. Labels and taints without node-specifier apply to all nodes.
+func mapNodesToNodeArgs(labels, taints []string, createdNodes []string) (map[string][]string, error) {
+	if err := validateNodeSpecifiers(labels, "node label"); err != nil {
+		return nil, err
+	}
+	if err := validateNodeSpecifiers(taints, "node taint"); err != nil {
+		return nil, err
+	}
+
+	args := []string{}
+	for _, label := range labels {
+		_, nodeLabel := extractNodes(label, "")
+		if err := validateNodeLabel(nodeLabel); err != nil {
+			return nil, err
+		}
+		args = append(args, "--node-label="+label)
+	}
+	for _, taint := range taints {
+		_, nodeTaint := extractNodes(taint, "")
+		if err := validateNodeTaint(nodeTaint); err != nil {
+			return nil, err
+		}
+		args = append(args, "--node-taint="+taint)
+	}
+
+	return mapNodesToSpecs(args, createdNodes, "all", "node label/taint"), nil
+}
@@ -0,0 +1,173 @@
+package cluster
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/rancher/k3d/runtimes"
+)
+
+func TestCreateWithNodeLabelsAndTaints(t *testing.T) {
+	ctx := context.Background()
+	rt := runtimes.NewFake()
+	spec := Spec{
+		Name:       "labels",
+		Image:      "rancher/k3s:v1",
+		APIPort:    "6550",
+		Workers:    2,
+		NodeLabels: []string{"env=dev", "tier=db@k3d-labels-worker-1"},
+		NodeTaints: []string{"dedicated=db:NoSchedule@workers", "gpu:NoExecute@server@k3d-labels-worker-0"},
+	}
+	if _, err := Create(ctx, rt, spec); err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	defer Delete(ctx, rt, spec.Name)
+
+	// the node-specifiers select the nodes and are cut off the arguments
+	args := []string{"--node-label=env=dev", "--node-label=tier=db", "--node-taint=dedicated=db:NoSchedule", "--node-taint=gpu:NoExecute"}
+	want := map[string][]string{
+		"k3d-labels-server":   {"--node-label=env=dev", "--node-taint=gpu:NoExecute"},
+		"k3d-labels-worker-0": {"--node-label=env=dev", "--node-taint=dedicated=db:NoSchedule", "--node-taint=gpu:NoExecute"},
+		"k3d-labels-worker-1": {"--node-label=env=dev", "--node-label=tier=db", "--node-taint=dedicated=db:NoSchedule"},
+	}
+	for node, nodeArgs := range want {
+		cmd := rt.Container(node).Config.Cmd
+		for _, arg := range args {
+			if got, want := containsString(cmd, arg), containsString(nodeArgs, arg); got != want {
+				t.Errorf("%s has %s: %t, want %t (command: %v)", node, arg, got, want, cmd)
+			}
+		}
+	}
+}
+
+func TestCreateWithInvalidNodeLabelsAndTaints(t *testing.T) {
+	tests := map[string]Spec{
+		"label without value":    {NodeLabels: []string{"env"}},
+		"label without key":      {NodeLabels: []string{"=dev@workers"}},
+		"taint without effect":   {NodeTaints: []string{"dedicated=db"}},
+		"misspelled effect":      {NodeTaints: []string{"dedicated=db:NoSchedul@workers"}},
+		"taint without key":      {NodeTaints: []string{"=db:NoSchedule"}},
+		"invalid node-specifier": {NodeLabels: []string{"env=dev@work_ers"}},
+	}
+	for name, spec := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			rt := runtimes.NewFake()
+			spec.Name, spec.Image, spec.APIPort, spec.Workers = "invalid", "rancher/k3s:v1", "6550", 1
+
+			if _, err := Create(ctx, rt, spec); err == nil {
+				t.Fatal("Create() succeeded, want an error")
+			}
+			// a typo mustn't leave a half-labelled cluster behind
+			if containers, _ := rt.ListContainers(ctx, map[string]string{"cluster": spec.Name}, true); len(containers) > 0 {
+				t.Errorf("Create() left containers %v behind", containers)
+			}
+		})
+	}
+}
+
+func TestSplitNodeSpecifiers(t *testing.T) {
+	possible := getPossibleNodeSpecifiers([]string{"k3d-test-server", "k3d-test-worker-0", "highmem", "k3d-test-highmem-0"})
+	tests := []struct {
+		spec      string
+		wantNodes []string
+		wantValue string
+	}{
+		{"FOO=bar", []string{"all"}, "FOO=bar"},
+		{"FOO=bar@workers", []string{"workers"}, "FOO=bar"},
+		{"FOO=bar@server@k3d-test-worker-0", []string{"server", "k3d-test-worker-0"}, "FOO=bar"},
+		{"FOO=bar@highmem", []string{"highmem"}, "FOO=bar"},
+		// values containing `@` are kept verbatim
+		{"EMAIL=foo@example.com", []string{"all"}, "EMAIL=foo@example.com"},
+		{"--datastore-endpoint=postgres://u:p@db:5432/k3s", []string{"all"}, "--datastore-endpoint=postgres://u:p@db:5432/k3s"},
+		{"EMAIL=foo@example.com@workers", []string{"workers"}, "EMAIL=foo@example.com"},
+		{"--datastore-endpoint=postgres://u:p@db:5432/k3s@server", []string{"server"}, "--datastore-endpoint=postgres://u:p@db:5432/k3s"},
+		// unknown node-specifiers are part of the value
+		{"FOO=bar@worker", []string{"all"}, "FOO=bar@worker"},
+		{"FOO=bar@unknown@workers", []string{"workers"}, "FOO=bar@unknown"},
+		{"FOO=bar@", []string{"all"}, "FOO=bar@"},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			nodes, value := splitNodeSpecifiers(test.spec, possible, "all")
+			if !reflect.DeepEqual(nodes, test.wantNodes) || value != test.wantValue {
+				t.Errorf("splitNodeSpecifiers(%q) = %v, %q, want %v, %q", test.spec, nodes, value, test.wantNodes, test.wantValue)
+			}
+		})
+	}
+}
+
+func TestMapNodesToValueSpecs(t *testing.T) {
+	nodes := []string{"k3d-test-server", "k3d-test-worker-0", "k3d-test-worker-1"}
+	tests := []struct {
+		name    string
+		specs   []string
+		want    map[string][]string
+		wantErr bool
+	}{
+		{"empty", []string{""}, map[string][]string{}, false},
+		{"default node", []string{"A=1"}, map[string][]string{"all": {"A=1"}}, false},
+		{"selected nodes", []string{"A=1@server@k3d-test-worker-0", "B=2@workers"}, map[string][]string{
+			"server":            {"A=1"},
+			"k3d-test-worker-0": {"A=1"},
+			"workers":           {"B=2"},
+		}, false},
+		{"values with @", []string{"EMAIL=foo@example.com", "URL=postgres://u:p@db:5432/k3s@server"}, map[string][]string{
+			"all":    {"EMAIL=foo@example.com"},
+			"server": {"URL=postgres://u:p@db:5432/k3s"},
+		}, false},
+		// a value ending with @<host name> needs a node-specifier to tell it apart from a typo
+		{"value ending with a host name", []string{"GIT_AUTHOR=alice@devbox@all"}, map[string][]string{"all": {"GIT_AUTHOR=alice@devbox"}}, false},
+		// mistyped node-specifiers mustn't silently apply to all nodes
+		{"mistyped node name", []string{"K=V@wrker-1"}, nil, true},
+		{"mistyped node name in a volume", []string{"/a:/b@wrker-1"}, nil, true},
+		{"mistyped role", []string{"K=V@worker"}, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := mapNodesToValueSpecs(test.specs, nodes, "all", "environment variable")
+			if (err != nil) != test.wantErr || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("mapNodesToValueSpecs(%v) = %v, %v, want %v, error: %t", test.specs, got, err, test.want, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidatePortSpecs(t *testing.T) {
+	nodes := []string{"k3d-test-server", "k3d-test-worker-0", "highmem", "k3d-test-highmem-0"}
+	valid := []string{"8080:80", "8080:80@server", "8443:443@workers@highmem", "9090:90@k3d-test-highmem-0"}
+	if err := validatePortSpecs(valid, nodes); err != nil {
+		t.Errorf("validatePortSpecs(%v) = %v, want no error", valid, err)
+	}
+	// the same typos as in mapNodesToValueSpecs
+	for _, spec := range []string{"8080:80@wrker-1", "8080:80@worker", "8080:80@server@k3d-test-wrker-0", "8080:80@work_ers", "http@server"} {
+		if err := validatePortSpecs([]string{spec}, nodes); err == nil {
+			t.Errorf("validatePortSpecs(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestMapNodesToRoleSpecs(t *testing.T) {
+	nodes := []string{"k3d-test-server", "k3d-test-worker-0"}
+	tests := []struct {
+		name  string
+		specs []string
+		want  map[string][]string
+	}{
+		{"default role", []string{"--datastore-endpoint=postgres://u:p@db:5432/k3s"}, map[string][]string{
+			"server": {"--datastore-endpoint=postgres://u:p@db:5432/k3s"},
+		}},
+		{"server name", []string{"--debug@k3d-test-server"}, map[string][]string{"k3d-test-server": {"--debug"}}},
+		// a worker can't get server arguments
+		{"other role", []string{"--debug@k3d-test-worker-0", "--debug@workers"}, map[string][]string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := mapNodesToRoleSpecs(test.specs, nodes, nodes[:1], "server", "server", "server argument")
+			if err != nil || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("mapNodesToRoleSpecs(%v) = %v, want %v", test.specs, got, test.want)
+			}
+		})
+	}
+}
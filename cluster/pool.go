@@ -0,0 +1,126 @@
+package cluster
+
+/*
+ * Node pools are groups of worker nodes with their own image and options. The name of a pool is a node-specifier,
+ * which selects its nodes, so the options of a pool are added to the cluster's options with the pool's name as
+ * node-specifier (e.g. the pool label tier=db becomes the node label tier=db@<pool>).
+ */
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PoolLabel is the container label holding the name of the node pool that a worker belongs to
+const PoolLabel = "pool"
+
+// Pool describes a node pool: Count workers named k3d-<cluster>-<name>-<n>, which run Image (default: the
+// image of the cluster) and get the options below in addition to the ones of the cluster (without node-specifiers)
+type Pool struct {
+	Name  string
+	Count int
+	Image string
+	// AgentArgs are passed to k3s agent
+	AgentArgs []string
+	Env       []string
+	Volumes   []string
+	// Publish maps the nodes' ports to the host (Format: [ip:][host-port:]container-port[/protocol])
+	Publish    []string
+	NodeLabels []string
+	NodeTaints []string
+	Memory     string
+	CPUs       string
+	PidsLimit  string
+}
+
+// reservedPoolNames can't be used as pool names, since they are node-specifiers or node names already
+var reservedPoolNames = []string{"all", "server", "master", "worker", "workers"}
+
+// validatePools checks the names of the node pools, which have to be unique and mustn't be node-specifiers already
+func validatePools(clusterName string, pools []Pool) error {
+	names := []string{}
+	for _, pool := range pools {
+		if err := ValidateHostname(pool.Name); err != nil {
+			return fmt.Errorf("Invalid node pool name [%s]\n%w", pool.Name, err)
+		}
+		if containsString(reservedPoolNames, pool.Name) {
+			return fmt.Errorf("Invalid node pool name [%s] (reserved: %s)", pool.Name, strings.Join(reservedPoolNames, ", "))
+		}
+		if containsString(names, pool.Name) {
+			return fmt.Errorf("Duplicate node pool name [%s]", pool.Name)
+		}
+		if pool.Count < 1 {
+			return fmt.Errorf("Node pool [%s] needs at least one node (count)", pool.Name)
+		}
+		if err := ValidateHostname(GetContainerName(pool.Name, clusterName, pool.Count-1)); err != nil {
+			return fmt.Errorf("Node pool name [%s] is too long for cluster [%s]\n%w", pool.Name, clusterName, err)
+		}
+		names = append(names, pool.Name)
+	}
+	return nil
+}
+
+// getPoolContainerNames returns the names of the pools (which are node-specifiers) and of all of their nodes
+func getPoolContainerNames(clusterName string, pools []Pool) []string {
+	names := []string{}
+	for _, pool := range pools {
+		names = append(names, pool.Name)
+		for postfix := 0; postfix < pool.Count; postfix++ {
+			names = append(names, GetContainerName(pool.Name, clusterName, postfix))
+		}
+	}
+	return names
+}
+
+// isPoolName checks whether name is the name of one of the node pools
+func isPoolName(pools []Pool, name string) bool {
+	for _, pool := range pools {
+		if pool.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// selectPool appends the pool's name as node-specifier to the specs
+func selectPool(specs []string, pool string) []string {
+	selected := []string{}
+	for _, spec := range specs {
+		selected = append(selected, fmt.Sprintf("%s@%s", spec, pool))
+	}
+	return selected
+}
+
+// withPoolOptions returns a copy of the spec, which has the options of the node pools added to its own options
+// with the pools' names as node-specifiers
+func (spec Spec) withPoolOptions() Spec {
+	copyOf := func(specs []string) []string { return append([]string{}, specs...) }
+	spec.AgentArgs = copyOf(spec.AgentArgs)
+	spec.Env = copyOf(spec.Env)
+	spec.Volumes = copyOf(spec.Volumes)
+	spec.Publish = copyOf(spec.Publish)
+	spec.NodeLabels = copyOf(spec.NodeLabels)
+	spec.NodeTaints = copyOf(spec.NodeTaints)
+	spec.Memory = copyOf(spec.Memory)
+	spec.CPUs = copyOf(spec.CPUs)
+	spec.PidsLimit = copyOf(spec.PidsLimit)
+
+	for _, pool := range spec.Pools {
+		spec.AgentArgs = append(spec.AgentArgs, selectPool(pool.AgentArgs, pool.Name)...)
+		spec.Env = append(spec.Env, selectPool(pool.Env, pool.Name)...)
+		spec.Volumes = append(spec.Volumes, selectPool(pool.Volumes, pool.Name)...)
+		spec.Publish = append(spec.Publish, selectPool(pool.Publish, pool.Name)...)
+		spec.NodeLabels = append(spec.NodeLabels, selectPool(pool.NodeLabels, pool.Name)...)
+		spec.NodeTaints = append(spec.NodeTaints, selectPool(pool.NodeTaints, pool.Name)...)
+		if pool.Memory != "" {
+			spec.Memory = append(spec.Memory, fmt.Sprintf("%s@%s", pool.Memory, pool.Name))
+		}
+		if pool.CPUs != "" {
+			spec.CPUs = append(spec.CPUs, fmt.Sprintf("%s@%s", pool.CPUs, pool.Name))
+		}
+		if pool.PidsLimit != "" {
+			spec.PidsLimit = append(spec.PidsLimit, fmt.Sprintf("%s@%s", pool.PidsLimit, pool.Name))
+		}
+	}
+	return spec
+}
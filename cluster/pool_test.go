@@ -0,0 +1,141 @@
+package cluster
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher/k3d/runtimes"
+)
+
+func TestValidatePools(t *testing.T) {
+	tests := []struct {
+		name    string
+		pools   []Pool
+		wantErr string
+	}{
+		{"valid", []Pool{{Name: "highmem", Count: 2}, {Name: "edge", Count: 1}}, ""},
+		// the pool's name would select all workers instead
+		{"reserved name", []Pool{{Name: "workers", Count: 1}}, "reserved"},
+		{"duplicate name", []Pool{{Name: "edge", Count: 1}, {Name: "edge", Count: 2}}, "Duplicate"},
+		{"no nodes", []Pool{{Name: "edge", Count: 0}}, "at least one node"},
+		{"invalid name", []Pool{{Name: "high_mem", Count: 1}}, "Invalid node pool name"},
+	}
+	for _, test := range tests {
+		err := validatePools("test", test.pools)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%s: validatePools() = %v, want no error", test.name, err)
+		} else if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%s: validatePools() = %v, want an error containing %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestCreateWithPools(t *testing.T) {
+	ctx := context.Background()
+	rt := runtimes.NewFake()
+	spec := Spec{
+		Name:       "pools",
+		Image:      "rancher/k3s:v1",
+		APIPort:    "6550",
+		Workers:    1,
+		NodeLabels: []string{"env=dev"},
+		Pools: []Pool{
+			{Name: "highmem", Count: 2, Image: "rancher/k3s:v2", Memory: "4g", NodeLabels: []string{"tier=db"}},
+			{Name: "edge", Count: 1, NodeTaints: []string{"edge=true:NoSchedule"}},
+		},
+	}
+	if _, err := Create(ctx, rt, spec); err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	defer Delete(ctx, rt, spec.Name)
+
+	tests := []struct {
+		node   string
+		pool   string
+		image  string
+		memory int64
+		args   []string
+	}{
+		{"k3d-pools-worker-0", "", "docker.io/rancher/k3s:v1", 0, []string{"--node-label=env=dev"}},
+		{"k3d-pools-highmem-0", "highmem", "docker.io/rancher/k3s:v2", 4 << 30, []string{"--node-label=env=dev", "--node-label=tier=db"}},
+		{"k3d-pools-highmem-1", "highmem", "docker.io/rancher/k3s:v2", 4 << 30, []string{"--node-label=env=dev", "--node-label=tier=db"}},
+		{"k3d-pools-edge-0", "edge", "docker.io/rancher/k3s:v1", 0, []string{"--node-label=env=dev", "--node-taint=edge=true:NoSchedule"}},
+	}
+	for _, test := range tests {
+		c := rt.Container(test.node)
+		if c == nil {
+			t.Errorf("container %s wasn't created", test.node)
+			continue
+		}
+		if c.Config.Labels[PoolLabel] != test.pool || c.Config.Labels["component"] != "worker" {
+			t.Errorf("%s has labels %v, want a worker of pool %q", test.node, c.Config.Labels, test.pool)
+		}
+		if c.Config.Image != test.image {
+			t.Errorf("%s runs %s, want %s", test.node, c.Config.Image, test.image)
+		}
+		if c.HostConfig.Resources.Memory != test.memory {
+			t.Errorf("%s has a memory limit of %d, want %d", test.node, c.HostConfig.Resources.Memory, test.memory)
+		}
+		// the options of a pool mustn't leak into the other workers
+		nodeArgs := []string{}
+		for _, arg := range c.Config.Cmd {
+			if strings.HasPrefix(arg, "--node-") {
+				nodeArgs = append(nodeArgs, arg)
+			}
+		}
+		if strings.Join(nodeArgs, " ") != strings.Join(test.args, " ") {
+			t.Errorf("%s has node arguments %v, want %v", test.node, nodeArgs, test.args)
+		}
+	}
+
+	cluster, err := Get(ctx, rt, spec.Name)
+	if err != nil || len(cluster.Workers) != 4 {
+		t.Errorf("Get() = %+v, %v, want 4 workers", cluster, err)
+	}
+}
+
+func TestCreateWithPoolsPublishesPorts(t *testing.T) {
+	ctx := context.Background()
+	rt := runtimes.NewFake()
+	spec := Spec{
+		Name:           "pools",
+		Image:          "rancher/k3s:v1",
+		APIPort:        "6550",
+		Workers:        2,
+		PortAutoOffset: 1,
+		Publish:        []string{"8080:80@workers", "8443:443@highmem"},
+		Pools:          []Pool{{Name: "highmem", Count: 2}},
+	}
+	if _, err := Create(ctx, rt, spec); err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	defer Delete(ctx, rt, spec.Name)
+
+	hostPorts := map[string]string{}
+	for _, node := range []string{"k3d-pools-worker-0", "k3d-pools-worker-1", "k3d-pools-highmem-0", "k3d-pools-highmem-1"} {
+		c := rt.Container(node)
+		if c == nil {
+			t.Fatalf("container %s wasn't created", node)
+		}
+		want := []string{"80/tcp"}
+		if strings.Contains(node, "highmem") {
+			want = append(want, "443/tcp")
+		}
+		for _, port := range want {
+			bindings := c.HostConfig.PortBindings[nat.Port(port)]
+			if len(bindings) != 1 {
+				t.Errorf("%s publishes %s on %v, want one host port", node, port, bindings)
+				continue
+			}
+			if other, ok := hostPorts[bindings[0].HostPort]; ok {
+				t.Errorf("%s and %s both publish host port %s", other, node, bindings[0].HostPort)
+			}
+			hostPorts[bindings[0].HostPort] = node
+		}
+		if len(c.HostConfig.PortBindings) != len(want) {
+			t.Errorf("%s publishes %v, want only %v", node, c.HostConfig.PortBindings, want)
+		}
+	}
+}
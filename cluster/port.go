@@ -1,8 +1,7 @@
-package run
+package cluster
 
 import (
 	"fmt"
-	"log"
 	"strings"
 
 	"github.com/docker/go-connections/nat"
@@ -17,49 +16,14 @@ type PublishedPorts struct {
 // defaultNodes describes the type of nodes on which a port should be exposed by default
 const defaultNodes = "server"
 
-// mapping a node role to groups that should be applied to it
-var nodeRuleGroupsMap = map[string][]string{
-	"worker": {"all", "workers"},
-	"server": {"all", "server", "master"},
-}
-
 // mapNodesToPortSpecs maps nodes to portSpecs
 func mapNodesToPortSpecs(specs []string, createdNodes []string) (map[string][]string, error) {
 
-	if err := validatePortSpecs(specs); err != nil {
+	if err := validatePortSpecs(specs, createdNodes); err != nil {
 		return nil, err
 	}
 
-	// check node-specifier possibilitites
-	possibleNodeSpecifiers := []string{"all", "workers", "server", "master"}
-	possibleNodeSpecifiers = append(possibleNodeSpecifiers, createdNodes...)
-
-	nodeToPortSpecMap := make(map[string][]string)
-
-	for _, spec := range specs {
-		nodes, portSpec := extractNodes(spec)
-
-		if len(nodes) == 0 {
-			nodes = append(nodes, defaultNodes)
-		}
-
-		for _, node := range nodes {
-			// check if node-specifier is valid (either a role or a name) and append to list if matches
-			nodeFound := false
-			for _, name := range possibleNodeSpecifiers {
-				if node == name {
-					nodeFound = true
-					nodeToPortSpecMap[node] = append(nodeToPortSpecMap[node], portSpec)
-					break
-				}
-			}
-			if !nodeFound {
-				log.Printf("WARNING: Unknown node-specifier [%s] in port mapping entry [%s]", node, spec)
-			}
-		}
-	}
-
-	return nodeToPortSpecMap, nil
+	return mapNodesToSpecs(specs, createdNodes, defaultNodes, "port mapping"), nil
 }
 
 // CreatePublishedPorts is the factory function for PublishedPorts
@@ -75,39 +39,24 @@ func CreatePublishedPorts(specs []string) (*PublishedPorts, error) {
 }
 
 // validatePortSpecs matches the provided port specs against a set of rules to enable early exit if something is wrong
-func validatePortSpecs(specs []string) error {
+func validatePortSpecs(specs []string, createdNodes []string) error {
+	possibleNodeSpecifiers := getPossibleNodeSpecifiers(createdNodes)
 	for _, spec := range specs {
 		atSplit := strings.Split(spec, "@")
 		_, err := nat.ParsePortSpec(atSplit[0])
 		if err != nil {
-			return fmt.Errorf("ERROR: Invalid port specification [%s] in port mapping [%s]\n%+v", atSplit[0], spec, err)
+			return fmt.Errorf("Invalid port specification [%s] in port mapping [%s]\n%w", atSplit[0], spec, err)
 		}
-		if len(atSplit) > 0 {
-			for i := 1; i < len(atSplit); i++ {
-				if err := ValidateHostname(atSplit[i]); err != nil {
-					return fmt.Errorf("ERROR: Invalid node-specifier [%s] in port mapping [%s]\n%+v", atSplit[i], spec, err)
-				}
+		// ports can't contain `@`, so every `@`-suffix is a node-specifier
+		for _, node := range atSplit[1:] {
+			if err := validateNodeSpecifier(node, spec, "port mapping", possibleNodeSpecifiers); err != nil {
+				return err
 			}
 		}
 	}
 	return nil
 }
 
-// extractNodes separates the node specification from the actual port specs
-func extractNodes(spec string) ([]string, string) {
-	// extract nodes
-	nodes := []string{}
-	atSplit := strings.Split(spec, "@")
-	portSpec := atSplit[0]
-	if len(atSplit) > 1 {
-		nodes = atSplit[1:]
-	}
-	if len(nodes) == 0 {
-		nodes = append(nodes, defaultNodes)
-	}
-	return nodes, portSpec
-}
-
 // Offset creates a new PublishedPort structure, with all host ports are changed by a fixed  'offset'
 func (p PublishedPorts) Offset(offset int) *PublishedPorts {
 	var newExposedPorts = make(map[nat.Port]struct{}, len(p.ExposedPorts))
@@ -166,38 +115,7 @@ func (p *PublishedPorts) AddPort(portSpec string) (*PublishedPorts, error) {
 	return &PublishedPorts{ExposedPorts: newExposedPorts, PortBindings: newPortBindings}, nil
 }
 
-// MergePortSpecs merges published ports for a given node
-func MergePortSpecs(nodeToPortSpecMap map[string][]string, role, name string) ([]string, error) {
-
-	portSpecs := []string{}
-
-	// add portSpecs according to node role
-	for _, group := range nodeRuleGroupsMap[role] {
-		for _, v := range nodeToPortSpecMap[group] {
-			exists := false
-			for _, i := range portSpecs {
-				if v == i {
-					exists = true
-				}
-			}
-			if !exists {
-				portSpecs = append(portSpecs, v)
-			}
-		}
-	}
-
-	// add portSpecs according to node name
-	for _, v := range nodeToPortSpecMap[name] {
-		exists := false
-		for _, i := range portSpecs {
-			if v == i {
-				exists = true
-			}
-		}
-		if !exists {
-			portSpecs = append(portSpecs, v)
-		}
-	}
-
-	return portSpecs, nil
+// nodePorts returns the port specs published on a node, which are selected by its role, its node pool or its name
+func (spec *nodeSpec) nodePorts(role, name string) []string {
+	return mergeNodeSpecs(spec.NodeToPortSpecMap, spec.nodeGroups(role), name)
 }
@@ -0,0 +1,150 @@
+package cluster
+
+/*
+ * Nodes in an internal network (--network-internal) can't reach the internet, but docker doesn't publish their ports
+ * either. Therefore, the ports of the nodes (including the API port) are published by a proxy container instead,
+ * which is attached to docker's default network and the cluster network and forwards the ports to the nodes.
+ */
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher/k3d/runtimes"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	proxyImage = "docker.io/alpine/socat:1.7.4.3-r0"
+	// the proxy listens on consecutive ports starting here (one per published port of a node)
+	proxyBasePort = 10000
+)
+
+// proxySpec collects the published ports of the nodes while they are created, which the proxy publishes instead
+type proxySpec struct {
+	rules []proxyRule
+}
+
+// proxyRule forwards a port published on the host to a port of a node
+type proxyRule struct {
+	Binding nat.PortBinding
+	Node    string
+	Port    nat.Port
+}
+
+// add records the published ports of a node
+func (p *proxySpec) add(node string, ports *PublishedPorts) {
+	containerPorts := []string{}
+	for port := range ports.PortBindings {
+		containerPorts = append(containerPorts, string(port))
+	}
+	sort.Strings(containerPorts)
+	for _, port := range containerPorts {
+		for _, binding := range ports.PortBindings[nat.Port(port)] {
+			p.rules = append(p.rules, proxyRule{Binding: binding, Node: node, Port: nat.Port(port)})
+		}
+	}
+}
+
+// socatCommand returns the shell command running a socat process per rule in the proxy container
+func (p *proxySpec) socatCommand() string {
+	processes := []string{}
+	for i, rule := range p.rules {
+		protocol := strings.ToUpper(rule.Port.Proto())
+		processes = append(processes, fmt.Sprintf("socat %s-LISTEN:%d,fork,reuseaddr %s:%s:%s &", protocol, proxyBasePort+i, protocol, rule.Node, rule.Port.Port()))
+	}
+	return strings.Join(append(processes, "wait"), " ")
+}
+
+// requiredImages returns the images that creating the cluster needs (besides the preloaded ones)
+func requiredImages(spec Spec, image string) []string {
+	images := []string{image}
+	for _, pool := range spec.Pools {
+		if pool.Image != "" && !containsString(images, fullImageName(pool.Image)) {
+			images = append(images, fullImageName(pool.Image))
+		}
+	}
+	if spec.NetworkInternal {
+		images = append(images, proxyImage)
+	}
+	if len(spec.ImportImages) > 0 {
+		images = append(images, k3dToolsImage)
+	}
+	return images
+}
+
+// checkLocalImages makes sure that the images are available locally, since clusters in an internal network
+// are meant to run without access to any registry
+func checkLocalImages(ctx context.Context, rt runtimes.Runtime, images []string) error {
+	missing := []string{}
+	for _, image := range images {
+		exists, err := rt.ImageExists(ctx, image)
+		if err != nil {
+			return fmt.Errorf("couldn't check whether image %s exists\n%w", image, err)
+		}
+		if !exists {
+			missing = append(missing, image)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Clusters in an internal network (--network-internal) don't pull images, but the images [%s] aren't available locally. Please pull them first (docker pull <image>)", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// createProxy creates and starts the proxy container publishing the ports of the nodes in the internal network
+func createProxy(ctx context.Context, rt runtimes.Runtime, spec *nodeSpec) (string, error) {
+	containerName := GetContainerName("proxy", spec.ClusterName, -1)
+	log.WithField("cluster", spec.ClusterName).Infof("Creating proxy %s for %d published ports...", containerName, len(spec.Proxy.rules))
+
+	exposedPorts := nat.PortSet{}
+	portBindings := nat.PortMap{}
+	for i, rule := range spec.Proxy.rules {
+		port := nat.Port(fmt.Sprintf("%d/%s", proxyBasePort+i, rule.Port.Proto()))
+		exposedPorts[port] = struct{}{}
+		portBindings[port] = []nat.PortBinding{rule.Binding}
+	}
+
+	hostConfig := &container.HostConfig{
+		PortBindings: portBindings,
+	}
+	if spec.AutoRestart {
+		hostConfig.RestartPolicy.Name = "unless-stopped"
+	}
+
+	config := &container.Config{
+		Hostname:     containerName,
+		Image:        proxyImage,
+		Entrypoint:   []string{"/bin/sh", "-c"},
+		Cmd:          []string{spec.Proxy.socatCommand()},
+		ExposedPorts: exposedPorts,
+		Labels: map[string]string{
+			"app":       "k3d",
+			"component": "proxy",
+			"created":   time.Now().Format("2006-01-02 15:04:05"),
+			"cluster":   spec.ClusterName,
+		},
+	}
+
+	// the proxy is created in docker's default network, which publishes its ports, and then attached to the cluster network
+	id, err := createContainer(ctx, rt, spec.Verbose, config, hostConfig, &network.NetworkingConfig{}, containerName)
+	if err != nil {
+		return "", err
+	}
+	if err := rt.ConnectNetwork(ctx, spec.Network, id, []string{containerName}); err != nil {
+		return "", fmt.Errorf("couldn't connect proxy %s to network %s\n%w", containerName, spec.Network, err)
+	}
+	if err := rt.StartContainer(ctx, id); err != nil {
+		if isPortInUse(err) {
+			return "", &Error{Kind: ErrPortInUse, Message: fmt.Sprintf("couldn't start proxy %s, one of its published ports is already in use", containerName), Err: err}
+		}
+		return "", fmt.Errorf("couldn't start proxy %s\n%w", containerName, err)
+	}
+	return id, nil
+}
@@ -0,0 +1,170 @@
+package cluster
+
+/*
+ * This file contains the resource limits (memory, CPUs and PIDs) of the nodes. Besides limiting the containers, the
+ * memory and CPU limits are reserved for the system in the kubelet, so that the allocatable resources of the node
+ * (which the scheduler works with) reflect the limits instead of the resources of the whole host.
+ */
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/docker/docker/api/types/container"
+	units "github.com/docker/go-units"
+)
+
+// Container labels recording the resource limits of a node (as given by the user)
+const (
+	MemoryLabel    = "memory"
+	CPUsLabel      = "cpus"
+	PidsLimitLabel = "pids-limit"
+)
+
+// nodeResources are the resource limits of a node (0 means unlimited) as given by the user and parsed
+type nodeResources struct {
+	Memory      string
+	MemoryBytes int64
+	CPUs        string
+	NanoCPUs    int64
+	PidsLimit   int64
+}
+
+// parseMemory parses a memory limit in Docker notation (e.g. 512m or 2g)
+func parseMemory(memory string) (int64, error) {
+	bytes, err := units.RAMInBytes(memory)
+	if err != nil || bytes <= 0 {
+		return 0, fmt.Errorf("Invalid memory limit [%s] (e.g. 512m or 2g)", memory)
+	}
+	return bytes, nil
+}
+
+// parseCPUs parses a CPU limit given as (fractional) number of CPUs (e.g. 1.5) into nano CPUs
+func parseCPUs(cpus string) (int64, error) {
+	value, err := strconv.ParseFloat(cpus, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("Invalid CPU limit [%s] (e.g. 0.5 or 2)", cpus)
+	}
+	return int64(value * 1e9), nil
+}
+
+// parsePidsLimit parses the maximum number of processes
+func parsePidsLimit(pidsLimit string) (int64, error) {
+	value, err := strconv.ParseInt(pidsLimit, 10, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("Invalid PIDs limit [%s] (e.g. 4096)", pidsLimit)
+	}
+	return value, nil
+}
+
+// validateResourceSpecs checks the resource limits and their node-specifiers before anything is created
+func validateResourceSpecs(memory, cpus, pidsLimits []string) error {
+	checks := []struct {
+		kind  string
+		specs []string
+		parse func(string) (int64, error)
+	}{
+		{"memory limit", memory, parseMemory},
+		{"CPU limit", cpus, parseCPUs},
+		{"PIDs limit", pidsLimits, parsePidsLimit},
+	}
+	for _, check := range checks {
+		if err := validateNodeSpecifiers(check.specs, check.kind); err != nil {
+			return err
+		}
+		for _, spec := range check.specs {
+			if _, value := extractNodes(spec, ""); value != "" {
+				if _, err := check.parse(value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// lastNodeSpec returns the most specific spec for a node, if any: the last spec selecting it by its name, else by
+// its node pool, its role or all nodes. groups are ordered from the least to the most specific (see nodeGroups).
+// The specs aren't merged, since a value repeated for a less specific group would otherwise win.
+func lastNodeSpec(nodeToSpecMap map[string][]string, groups []string, name string) string {
+	if specs := nodeToSpecMap[name]; len(specs) > 0 {
+		return specs[len(specs)-1]
+	}
+	for i := len(groups) - 1; i >= 0; i-- {
+		if specs := nodeToSpecMap[groups[i]]; len(specs) > 0 {
+			return specs[len(specs)-1]
+		}
+	}
+	return ""
+}
+
+// nodeResources returns the resource limits of a node
+func (spec *nodeSpec) nodeResources(role, name string) (nodeResources, error) {
+	var err error
+	resources := nodeResources{
+		Memory: lastNodeSpec(spec.NodeToMemoryMap, spec.nodeGroups(role), name),
+		CPUs:   lastNodeSpec(spec.NodeToCPUsMap, spec.nodeGroups(role), name),
+	}
+	if resources.Memory != "" {
+		if resources.MemoryBytes, err = parseMemory(resources.Memory); err != nil {
+			return resources, err
+		}
+	}
+	if resources.CPUs != "" {
+		if resources.NanoCPUs, err = parseCPUs(resources.CPUs); err != nil {
+			return resources, err
+		}
+	}
+	if pidsLimit := lastNodeSpec(spec.NodeToPidsLimitMap, spec.nodeGroups(role), name); pidsLimit != "" {
+		if resources.PidsLimit, err = parsePidsLimit(pidsLimit); err != nil {
+			return resources, err
+		}
+	}
+	return resources, nil
+}
+
+// containerResources returns the resource constraints of the node's container
+func (r nodeResources) containerResources() container.Resources {
+	resources := container.Resources{
+		Memory:   r.MemoryBytes,
+		NanoCPUs: r.NanoCPUs,
+	}
+	if r.PidsLimit > 0 {
+		resources.PidsLimit = &r.PidsLimit
+	}
+	return resources
+}
+
+// labels returns the container labels recording the resource limits of the node
+func (r nodeResources) labels() map[string]string {
+	labels := map[string]string{}
+	if r.Memory != "" {
+		labels[MemoryLabel] = r.Memory
+	}
+	if r.CPUs != "" {
+		labels[CPUsLabel] = r.CPUs
+	}
+	if r.PidsLimit > 0 {
+		labels[PidsLimitLabel] = strconv.FormatInt(r.PidsLimit, 10)
+	}
+	return labels
+}
+
+// kubeletArgs returns the k3s arguments that reserve the part of the host's resources exceeding the limits
+// for the system, since the kubelet in the container sees all CPUs and the whole memory of the host
+func (r nodeResources) kubeletArgs(hostCPUs int, hostMemory int64) []string {
+	reserved := ""
+	if reservedCPUs := int64(hostCPUs)*1000 - r.NanoCPUs/1e6; r.NanoCPUs > 0 && reservedCPUs > 0 {
+		reserved = fmt.Sprintf("cpu=%dm", reservedCPUs)
+	}
+	if reservedMemory := hostMemory - r.MemoryBytes; r.MemoryBytes > 0 && reservedMemory > 0 {
+		if reserved != "" {
+			reserved += ","
+		}
+		reserved += fmt.Sprintf("memory=%dMi", reservedMemory/(1<<20))
+	}
+	if reserved == "" {
+		return []string{}
+	}
+	return []string{"--kubelet-arg=system-reserved=" + reserved}
+}
@@ -0,0 +1,151 @@
+package cluster
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rancher/k3d/runtimes"
+)
+
+func TestParseLimits(t *testing.T) {
+	parsers := map[string]func(string) (int64, error){
+		"memory":     parseMemory,
+		"cpus":       parseCPUs,
+		"pids-limit": parsePidsLimit,
+	}
+	tests := []struct {
+		kind    string
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"memory", "512m", 512 << 20, false},
+		{"memory", "512Mi", 512 << 20, false},
+		{"memory", "1.5g", 3 << 29, false},
+		{"memory", "0", 0, true},
+		{"memory", "-1g", 0, true},
+		{"memory", "2x", 0, true},
+		{"cpus", "0.5", 5e8, false},
+		{"cpus", "2", 2e9, false},
+		// Kubernetes' millicores aren't Docker's notation
+		{"cpus", "500m", 0, true},
+		{"cpus", "0", 0, true},
+		{"pids-limit", "4096", 4096, false},
+		{"pids-limit", "4k", 0, true},
+		{"pids-limit", "-1", 0, true},
+	}
+	for _, test := range tests {
+		got, err := parsers[test.kind](test.value)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("parsing %s %q = %d, %v, want %d, error: %t", test.kind, test.value, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestNodeResources(t *testing.T) {
+	nodes := []string{"k3d-test-server", "k3d-test-worker-0", "k3d-test-worker-1"}
+	spec := nodeSpec{
+		NodeToMemoryMap:    mapNodesToSpecs([]string{"1g", "4g@workers", "2g@k3d-test-worker-1"}, nodes, "all", "memory limit"),
+		NodeToCPUsMap:      mapNodesToSpecs([]string{"0.5@k3d-test-worker-0", "2@server"}, nodes, "all", "CPU limit"),
+		NodeToPidsLimitMap: mapNodesToSpecs([]string{"4096@all"}, nodes, "all", "PIDs limit"),
+	}
+
+	// the node's name wins over its role, its role wins over all nodes
+	want := map[string]nodeResources{
+		"k3d-test-server":   {Memory: "1g", MemoryBytes: 1 << 30, CPUs: "2", NanoCPUs: 2e9, PidsLimit: 4096},
+		"k3d-test-worker-0": {Memory: "4g", MemoryBytes: 4 << 30, CPUs: "0.5", NanoCPUs: 5e8, PidsLimit: 4096},
+		"k3d-test-worker-1": {Memory: "2g", MemoryBytes: 2 << 30, PidsLimit: 4096},
+	}
+	for _, name := range nodes {
+		role := "worker"
+		if name == "k3d-test-server" {
+			role = "server"
+		}
+		got, err := spec.nodeResources(role, name)
+		if err != nil || got != want[name] {
+			t.Errorf("nodeResources(%s) = %+v, %v, want %+v", name, got, err, want[name])
+		}
+	}
+}
+
+func TestNodeResourcesRepeatedValue(t *testing.T) {
+	// --memory 2g --memory 4g@workers --memory 2g@k3d-x-worker-0
+	nodes := []string{"k3d-x-server", "k3d-x-worker-0", "k3d-x-worker-1"}
+	spec := nodeSpec{NodeToMemoryMap: mapNodesToSpecs([]string{"2g", "4g@workers", "2g@k3d-x-worker-0"}, nodes, "all", "memory limit")}
+
+	for name, want := range map[string]string{"k3d-x-server": "2g", "k3d-x-worker-0": "2g", "k3d-x-worker-1": "4g"} {
+		role := "worker"
+		if name == "k3d-x-server" {
+			role = "server"
+		}
+		if got, err := spec.nodeResources(role, name); err != nil || got.Memory != want {
+			t.Errorf("nodeResources(%s) has memory %q (%v), want %q", name, got.Memory, err, want)
+		}
+	}
+}
+
+func TestKubeletArgs(t *testing.T) {
+	const hostCPUs, hostMemory = 4, 8 << 30
+	tests := []struct {
+		name      string
+		resources nodeResources
+		want      []string
+	}{
+		{"unlimited", nodeResources{}, []string{}},
+		{"memory and CPUs", nodeResources{MemoryBytes: 2 << 30, NanoCPUs: 15e8}, []string{"--kubelet-arg=system-reserved=cpu=2500m,memory=6144Mi"}},
+		{"CPUs only", nodeResources{NanoCPUs: 5e8}, []string{"--kubelet-arg=system-reserved=cpu=3500m"}},
+		// limits exceeding the host don't reserve anything
+		{"above the host", nodeResources{MemoryBytes: 16 << 30, NanoCPUs: 8e9}, []string{}},
+		{"PIDs limit only", nodeResources{PidsLimit: 4096}, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.resources.kubeletArgs(hostCPUs, hostMemory); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("kubeletArgs(%d, %d) = %v, want %v", hostCPUs, hostMemory, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCreateWithResourceLimits(t *testing.T) {
+	ctx := context.Background()
+	rt := runtimes.NewFake()
+	spec := Spec{
+		Name:      "limits",
+		Image:     "rancher/k3s:v1",
+		APIPort:   "6550",
+		Workers:   1,
+		Memory:    []string{"2g@workers"},
+		CPUs:      []string{"1.5@k3d-limits-worker-0"},
+		PidsLimit: []string{"4096"},
+	}
+	if _, err := Create(ctx, rt, spec); err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	defer Delete(ctx, rt, spec.Name)
+
+	worker := rt.Container("k3d-limits-worker-0")
+	if r := worker.HostConfig.Resources; r.Memory != 2<<30 || r.NanoCPUs != 15e8 || r.PidsLimit == nil || *r.PidsLimit != 4096 {
+		t.Errorf("worker has resources %+v, want 2g of memory, 1.5 CPUs and 4096 PIDs", r)
+	}
+	// list -o wide shows the limits as given by the user
+	if labels := worker.Config.Labels; labels[MemoryLabel] != "2g" || labels[CPUsLabel] != "1.5" || labels[PidsLimitLabel] != "4096" {
+		t.Errorf("worker has labels %v, want the limits recorded", labels)
+	}
+	// the fake host has 4 CPUs and 8 GiB of memory
+	if !containsString(worker.Config.Cmd, "--kubelet-arg=system-reserved=cpu=2500m,memory=6144Mi") {
+		t.Errorf("worker has command %v, want the resources above the limits reserved", worker.Config.Cmd)
+	}
+
+	server := rt.Container("k3d-limits-server")
+	if r := server.HostConfig.Resources; r.Memory != 0 || r.NanoCPUs != 0 {
+		t.Errorf("server has resources %+v, want only the PIDs limit", r)
+	}
+	for _, arg := range server.Config.Cmd {
+		if strings.HasPrefix(arg, "--kubelet-arg") {
+			t.Errorf("server has kubelet argument %s, want nothing reserved", arg)
+		}
+	}
+}
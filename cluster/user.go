@@ -0,0 +1,195 @@
+package cluster
+
+/*
+ * The functions in this file create kubeconfigs for additional (non-admin) users of a cluster.
+ * Their client certificates are signed by the client CA of the k3s server.
+ */
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rancher/k3d/runtimes"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	k3sClientCACertPath = "/var/lib/rancher/k3s/server/tls/client-ca.crt"
+	k3sClientCAKeyPath  = "/var/lib/rancher/k3s/server/tls/client-ca.key"
+	// userCertValidity is the validity period of the client certificates created for users
+	userCertValidity = 365 * 24 * time.Hour
+)
+
+// invalidUserNameChars matches everything in a user name that can't be used in file or kubernetes object names
+var invalidUserNameChars = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+
+// UserSpec describes a restricted user of a cluster
+type UserSpec struct {
+	Name        string
+	Groups      []string
+	ClusterRole string
+}
+
+// CreateUserKubeConfig signs a client certificate for the user with the cluster's client CA,
+// binds the user to the cluster role (if any) and returns a kubeconfig for that identity
+func CreateUserKubeConfig(ctx context.Context, rt runtimes.Runtime, cluster string, user UserSpec) ([]byte, error) {
+	if user.Name == "" {
+		return nil, fmt.Errorf("no user name provided")
+	}
+
+	c, err := Get(ctx, rt, cluster)
+	if err != nil {
+		return nil, err
+	}
+	server := c.Server
+
+	// the client CA never leaves the memory of this process
+	caCert, caKey, err := getClientCA(ctx, rt, server.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := log.WithFields(log.Fields{"cluster": cluster, "user": user.Name})
+	logger.Infof("Signing client certificate for user [%s] (groups %s)", user.Name, user.Groups)
+	certPEM, keyPEM, err := signClientCertificate(caCert, caKey, user)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.ClusterRole != "" {
+		bindingName := fmt.Sprintf("k3d-user-%s-%s", sanitizeUserName(user.Name), user.ClusterRole)
+		logger.Infof("Binding user [%s] to cluster role [%s]", user.Name, user.ClusterRole)
+		output, err := executeInContainer(ctx, rt, server.ID, []string{"kubectl", "create", "clusterrolebinding", bindingName, "--clusterrole", user.ClusterRole, "--user", user.Name})
+		if err != nil && !strings.Contains(output, "AlreadyExists") {
+			return nil, err
+		}
+	}
+
+	// re-use the cluster entry (server URL and CA) of the admin kubeconfig
+	config, err := fetchKubeConfig(ctx, rt, cluster, false)
+	if err != nil {
+		return nil, err
+	}
+	config.Users = []kubeConfigUser{{Name: user.Name}}
+	config.Users[0].User.ClientCertificateData = base64.StdEncoding.EncodeToString(certPEM)
+	config.Users[0].User.ClientKeyData = base64.StdEncoding.EncodeToString(keyPEM)
+	config.rename(fmt.Sprintf("%s-%s", kubeConfigContextName(cluster), sanitizeUserName(user.Name)))
+
+	return config.marshal()
+}
+
+// getClientCA reads the client CA certificate and key from the k3s server container
+func getClientCA(ctx context.Context, rt runtimes.Runtime, serverID string) (*x509.Certificate, crypto.Signer, error) {
+	certBytes, err := readFileFromContainer(ctx, rt, serverID, k3sClientCACertPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, _ := pem.Decode(certBytes)
+	if certBlock == nil {
+		return nil, nil, fmt.Errorf("no PEM data found in %s", k3sClientCACertPath)
+	}
+	caCert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't parse client CA certificate\n%w", err)
+	}
+
+	keyBytes, err := readFileFromContainer(ctx, rt, serverID, k3sClientCAKeyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBlock, _ := pem.Decode(keyBytes)
+	if keyBlock == nil {
+		return nil, nil, fmt.Errorf("no PEM data found in %s", k3sClientCAKeyPath)
+	}
+	caKey, err := parsePrivateKey(keyBlock)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't parse client CA key\n%w", err)
+	}
+
+	return caCert, caKey, nil
+}
+
+// parsePrivateKey parses EC, PKCS#1 (RSA) and PKCS#8 private keys
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case *rsa.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", key)
+}
+
+// signClientCertificate creates a new key and a client certificate for the user (CN=<user>, O=<groups>),
+// signed by the CA. It returns certificate and key PEM encoded.
+func signClientCertificate(caCert *x509.Certificate, caKey crypto.Signer, user UserSpec) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't generate key\n%w", err)
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't generate serial number\n%w", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   user.Name,
+			Organization: user.Groups,
+		},
+		NotBefore:   time.Now().Add(-time.Minute), // tolerate small clock skews between host and nodes
+		NotAfter:    time.Now().Add(userCertValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't sign client certificate\n%w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't encode key\n%w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// sanitizeUserName turns a user name (e.g. an email address) into something usable in file and object names
+func sanitizeUserName(name string) string {
+	return strings.ToLower(invalidUserNameChars.ReplaceAllString(name, "-"))
+}
+
+// UserKubeConfigPath returns the path of the user's kubeconfig file in the cluster directory
+func UserKubeConfigPath(cluster, user string) (string, error) {
+	clusterDir, err := getClusterDir(cluster)
+	return path.Join(clusterDir, fmt.Sprintf("kubeconfig-%s.yaml", sanitizeUserName(user))), err
+}
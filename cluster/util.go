@@ -1,6 +1,7 @@
-package run
+package cluster
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"net"
@@ -46,6 +47,22 @@ func GenerateRandomString(n int) string {
 	return sb.String()
 }
 
+// sleep pauses for the given duration, but returns the context's error early if ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// CleanupContext returns a context for cleaning up after an operation, which isn't canceled together with
+// the operation's context (e.g. to remove helper containers or a temporary cluster after Ctrl-C)
+func CleanupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), cleanupTimeout)
+}
+
 /*** Cluster Name Validation ***/
 const clusterNameMaxSize int = 35
 
@@ -55,10 +72,10 @@ const clusterNameMaxSize int = 35
 // within the 64 characters limit.
 func CheckClusterName(name string) error {
 	if err := ValidateHostname(name); err != nil {
-		return fmt.Errorf("[ERROR] Invalid cluster name\n%+v", ValidateHostname(name))
+		return fmt.Errorf("Invalid cluster name\n%+v", ValidateHostname(name))
 	}
 	if len(name) > clusterNameMaxSize {
-		return fmt.Errorf("[ERROR] Cluster name is too long (%d > %d)", len(name), clusterNameMaxSize)
+		return fmt.Errorf("Cluster name is too long (%d > %d)", len(name), clusterNameMaxSize)
 	}
 	return nil
 }
@@ -67,11 +84,11 @@ func CheckClusterName(name string) error {
 func ValidateHostname(name string) error {
 
 	if len(name) == 0 {
-		return fmt.Errorf("[ERROR] no name provided")
+		return fmt.Errorf("no name provided")
 	}
 
 	if name[0] == '-' || name[len(name)-1] == '-' {
-		return fmt.Errorf("[ERROR] Hostname [%s] must not start or end with - (dash)", name)
+		return fmt.Errorf("Hostname [%s] must not start or end with - (dash)", name)
 	}
 
 	for _, c := range name {
@@ -82,7 +99,7 @@ func ValidateHostname(name string) error {
 		case c == '-':
 			break
 		default:
-			return fmt.Errorf("[ERROR] Hostname [%s] contains characters other than 'Aa-Zz', '0-9' or '-'", name)
+			return fmt.Errorf("Hostname [%s] contains characters other than 'Aa-Zz', '0-9' or '-'", name)
 
 		}
 	}
@@ -90,22 +107,20 @@ func ValidateHostname(name string) error {
 	return nil
 }
 
+// parseAPIPort parses the API port given as [host:]port, where IPv6 addresses are enclosed in brackets ([::1]:6443)
 func parseAPIPort(portSpec string) (*apiPort, error) {
-	var port *apiPort
-	split := strings.Split(portSpec, ":")
-	if len(split) > 2 {
-		return nil, fmt.Errorf("api-port format error")
-	}
-
-	if len(split) == 1 {
-		port = &apiPort{Port: split[0]}
-	} else {
+	port := &apiPort{Port: portSpec}
+	if strings.Contains(portSpec, ":") {
+		host, p, err := net.SplitHostPort(portSpec)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --api-port [%s] (Format: [host:]port, e.g. 0.0.0.0:6443 or [::1]:6443)\n%w", portSpec, err)
+		}
 		// Make sure 'host' can be resolved to an IP address
-		addrs, err := net.LookupHost(split[0])
+		addrs, err := net.LookupHost(host)
 		if err != nil {
 			return nil, err
 		}
-		port = &apiPort{Host: split[0], HostIP: addrs[0], Port: split[1]}
+		port = &apiPort{Host: host, HostIP: addrs[0], Port: p}
 	}
 
 	// Verify 'port' is an integer and within port ranges
@@ -115,8 +130,28 @@ func parseAPIPort(portSpec string) (*apiPort, error) {
 	}
 
 	if p < 0 || p > 65535 {
-		return nil, fmt.Errorf("ERROR: --api-port port value out of range")
+		return nil, fmt.Errorf("--api-port port value out of range")
 	}
 
 	return port, nil
 }
+
+// FreePort returns a port on the host that is currently unused, e.g. for the API server of temporary clusters
+func FreePort() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("couldn't find a free port\n%w", err)
+	}
+	defer listener.Close()
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port), nil
+}
+
+// containsString checks whether the slice contains the string s
+func containsString(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAPIPort(t *testing.T) {
+	tests := []struct {
+		portSpec string
+		want     *apiPort
+		wantErr  bool
+	}{
+		{"6443", &apiPort{Port: "6443"}, false},
+		{"127.0.0.1:6443", &apiPort{Host: "127.0.0.1", HostIP: "127.0.0.1", Port: "6443"}, false},
+		// IPv6 addresses are enclosed in brackets, since they contain colons themselves
+		{"[::1]:6443", &apiPort{Host: "::1", HostIP: "::1", Port: "6443"}, false},
+		{"[fd00::10]:6443", &apiPort{Host: "fd00::10", HostIP: "fd00::10", Port: "6443"}, false},
+		{"::1:6443", nil, true},
+		{"[::1]", nil, true},
+		{"127.0.0.1:api", nil, true},
+		{"70000", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.portSpec, func(t *testing.T) {
+			got, err := parseAPIPort(test.portSpec)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseAPIPort(%q) = %v, want error: %t", test.portSpec, err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseAPIPort(%q) = %+v, want %+v", test.portSpec, got, test.want)
+			}
+		})
+	}
+}
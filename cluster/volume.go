@@ -0,0 +1,127 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/rancher/k3d/runtimes"
+)
+
+// createImageVolume will create a new docker volume used for storing image tarballs that can be loaded into the clusters
+func createImageVolume(ctx context.Context, rt runtimes.Runtime, clusterName string) (types.Volume, error) {
+	return createClusterVolume(ctx, rt, clusterName, fmt.Sprintf("k3d-%s-images", clusterName))
+}
+
+// createPreloadVolume creates the docker volume holding the tarball of the images preloaded at creation (--import-image).
+// It's mounted into k3s' agent images directory, so it mustn't hold any other tarballs (e.g. exported images), since
+// every node imports everything in there at each start.
+func createPreloadVolume(ctx context.Context, rt runtimes.Runtime, clusterName string) (types.Volume, error) {
+	return createClusterVolume(ctx, rt, clusterName, fmt.Sprintf("k3d-%s-preload", clusterName))
+}
+
+// createClusterVolume creates a docker volume belonging to the cluster, which is deleted together with it
+func createClusterVolume(ctx context.Context, rt runtimes.Runtime, clusterName, volName string) (types.Volume, error) {
+
+	var vol types.Volume
+
+	volumeCreateOptions := volume.VolumeCreateBody{
+		Name: volName,
+		Labels: map[string]string{
+			"app":     "k3d",
+			"cluster": clusterName,
+		},
+		Driver:     "local", //TODO: allow setting driver + opts
+		DriverOpts: map[string]string{},
+	}
+	vol, err := rt.CreateVolume(ctx, volumeCreateOptions)
+	if err != nil {
+		return vol, fmt.Errorf("failed to create image volume [%s] for cluster [%s]\n%w", volName, clusterName, err)
+	}
+
+	return vol, nil
+}
+
+// deleteImageVolume will delete the volumes we created for sharing images with this cluster (image and preload volume)
+func deleteImageVolume(ctx context.Context, rt runtimes.Runtime, clusterName string) error {
+	volumes, err := rt.ListVolumes(ctx, map[string]string{"app": "k3d", "cluster": clusterName})
+	if err != nil {
+		return fmt.Errorf("couldn't get volumes for cluster [%s]\n%w", clusterName, err)
+	}
+
+	for _, volume := range volumes {
+		if err := rt.RemoveVolume(ctx, volume.Name); err != nil {
+			return fmt.Errorf("couldn't remove volume [%s] for cluster [%s]\n%w", volume.Name, clusterName, err)
+		}
+	}
+
+	return nil
+}
+
+// getImageVolume returns the docker volume object representing the imagevolume for the cluster
+func getImageVolume(ctx context.Context, rt runtimes.Runtime, clusterName string) (types.Volume, error) {
+	var vol types.Volume
+	volName := fmt.Sprintf("k3d-%s-images", clusterName)
+	volumes, err := rt.ListVolumes(ctx, map[string]string{"app": "k3d", "cluster": clusterName})
+	if err != nil {
+		return vol, fmt.Errorf("couldn't get volumes for cluster [%s]\n%+v ", clusterName, err)
+	}
+	volFound := false
+	for _, volume := range volumes {
+		if volume.Name == volName {
+			vol = *volume
+			volFound = true
+			break
+		}
+	}
+	if !volFound {
+		return vol, fmt.Errorf("didn't find volume [%s] in list of volumes returned for cluster [%s]", volName, clusterName)
+	}
+
+	return vol, nil
+}
+
+// createImageCacheVolume returns the host-wide docker volume shared by all k3d clusters for caching image tarballs
+// and creates it, if it doesn't exist yet
+func createImageCacheVolume(ctx context.Context, rt runtimes.Runtime) (types.Volume, error) {
+
+	var vol types.Volume
+	volumes, err := rt.ListVolumes(ctx, map[string]string{"app": "k3d", "component": "image-cache"})
+	if err != nil {
+		return vol, fmt.Errorf("couldn't list volumes\n%w", err)
+	}
+	for _, volume := range volumes {
+		if volume.Name == imageCacheVolumeName {
+			return *volume, nil
+		}
+	}
+
+	// the image cache doesn't belong to a single cluster, so it doesn't get a cluster label
+	// and it won't be deleted together with a cluster
+	volumeCreateOptions := volume.VolumeCreateBody{
+		Name: imageCacheVolumeName,
+		Labels: map[string]string{
+			"app":       "k3d",
+			"component": "image-cache",
+		},
+		Driver:     "local",
+		DriverOpts: map[string]string{},
+	}
+	vol, err = rt.CreateVolume(ctx, volumeCreateOptions)
+	if err != nil {
+		return vol, fmt.Errorf("failed to create image cache volume [%s]\n%w", imageCacheVolumeName, err)
+	}
+
+	return vol, nil
+}
+
+// usesImageCache returns whether the shared image cache volume is mounted in the given node container
+func usesImageCache(node types.Container) bool {
+	for _, mount := range node.Mounts {
+		if mount.Name == imageCacheVolumeName && mount.Destination == imageCachePathRemote {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,225 @@
+// Package k3dtest creates ephemeral k3d clusters for Go tests.
+//
+//	func TestDeployment(t *testing.T) {
+//		c := k3dtest.NewCluster(t, k3dtest.WithWorkers(1))
+//		// use c.KubeConfigPath, e.g. with client-go's clientcmd.BuildConfigFromFlags("", c.KubeConfigPath)
+//	}
+//
+// The cluster is deleted when the test (including its subtests) finishes, even if it fails or panics.
+package k3dtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/rancher/k3d/cluster"
+	"github.com/rancher/k3d/runtimes"
+	"github.com/rancher/k3d/version"
+)
+
+const (
+	// DefaultTimeout is the time to wait for a cluster to be up and running unless WithTimeout is given
+	DefaultTimeout = 5 * time.Minute
+)
+
+// Cluster is a running cluster created by NewCluster
+type Cluster struct {
+	*cluster.Cluster
+	// KubeConfigPath is the path of the admin kubeconfig file of the cluster
+	KubeConfigPath string
+	// Runtime is the container runtime that the cluster runs in
+	Runtime runtimes.Runtime
+}
+
+// ServerContainerName returns the name of the cluster's server container
+func (c *Cluster) ServerContainerName() string {
+	return cluster.GetContainerName("server", c.Name, -1)
+}
+
+// Option configures the cluster created by NewCluster
+type Option func(*options)
+
+type options struct {
+	spec    cluster.Spec
+	runtime runtimes.Runtime
+}
+
+// WithImage sets the k3s image (default: the same image as `k3d create`)
+func WithImage(image string) Option {
+	return func(o *options) { o.spec.Image = image }
+}
+
+// WithWorkers sets the number of worker nodes (default: 0)
+func WithWorkers(workers int) Option {
+	return func(o *options) { o.spec.Workers = workers }
+}
+
+// WithTimeout sets the time to wait for the cluster to be ready (default: DefaultTimeout, 0 waits forever)
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) { o.spec.Timeout = timeout }
+}
+
+// WithRuntime sets the container runtime, e.g. runtimes.NewFake() for tests that don't need a running cluster
+// (default: the runtime selected by $K3D_RUNTIME, see runtimes.New)
+func WithRuntime(rt runtimes.Runtime) Option {
+	return func(o *options) { o.runtime = rt }
+}
+
+// WithSpec modifies the spec of the cluster (e.g. to publish ports or to set server arguments)
+func WithSpec(modify func(spec *cluster.Spec)) Option {
+	return func(o *options) { modify(&o.spec) }
+}
+
+// uniqueName generates a valid cluster name that won't collide with other tests (or their leftovers)
+func uniqueName() string {
+	return fmt.Sprintf("k3dtest-%s", strings.ToLower(cluster.GenerateRandomString(8)))
+}
+
+// NewCluster creates a uniquely named cluster, waits until its API server and all of its nodes are ready and
+// deletes it again when the test finishes. It fails the test if the cluster can't be created or isn't ready in time.
+func NewCluster(t testing.TB, opts ...Option) *Cluster {
+	t.Helper()
+	ctx := context.Background()
+
+	o := &options{
+		spec: cluster.Spec{
+			Name:    uniqueName(),
+			Image:   fmt.Sprintf("docker.io/rancher/k3s:%s", version.GetK3sVersion()),
+			Wait:    true,
+			Timeout: DefaultTimeout,
+		},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.runtime == nil {
+		rt, err := runtimes.New(os.Getenv("K3D_RUNTIME"))
+		if err != nil {
+			t.Fatalf("k3dtest: %+v", err)
+		}
+		o.runtime = rt
+	}
+
+	if o.spec.APIPort == "" {
+		port, err := cluster.FreePort()
+		if err != nil {
+			t.Fatalf("k3dtest: %+v", err)
+		}
+		o.spec.APIPort = port
+	}
+
+	// Create deletes the cluster again if it fails
+	start := time.Now()
+	c, err := cluster.Create(ctx, o.runtime, o.spec)
+	if err != nil {
+		t.Fatalf("k3dtest: %+v", err)
+	}
+	t.Cleanup(func() {
+		if err := cluster.Delete(ctx, o.runtime, c.Name); err != nil {
+			t.Errorf("k3dtest: %+v", err)
+		}
+	})
+
+	kubeConfigPath, err := cluster.KubeConfigPath(ctx, o.runtime, c.Name, false, false)
+	if err != nil {
+		t.Fatalf("k3dtest: %+v", err)
+	}
+
+	k3dCluster := &Cluster{
+		Cluster:        c,
+		KubeConfigPath: kubeConfigPath,
+		Runtime:        o.runtime,
+	}
+
+	// Create only waits for the server's kubelet, but tests need the API server and the workers as well
+	var deadline time.Time
+	if o.spec.Timeout != 0 {
+		deadline = start.Add(o.spec.Timeout)
+	}
+	if err := k3dCluster.waitForReady(ctx, deadline); err != nil {
+		t.Fatalf("k3dtest: %+v", err)
+	}
+
+	return k3dCluster
+}
+
+// waitForReady polls the cluster until it's ready (see checkReady), but gives up after the deadline (if not zero)
+func (c *Cluster) waitForReady(ctx context.Context, deadline time.Time) error {
+	for {
+		err := c.checkReady(ctx)
+		if err == nil {
+			return nil
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return fmt.Errorf("cluster [%s] isn't ready within the timeout\n%w", c.Name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// checkReady checks that the API server is ready and that all nodes of the cluster are registered and Ready,
+// using kubectl in the server container
+func (c *Cluster) checkReady(ctx context.Context) error {
+	output, exitCode, err := c.Runtime.Exec(ctx, c.Server.ID, []string{"kubectl", "get", "--raw", "/readyz"})
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 || strings.TrimSpace(output) != "ok" {
+		return fmt.Errorf("API server isn't ready:\n%s", output)
+	}
+
+	output, exitCode, err = c.Runtime.Exec(ctx, c.Server.ID, []string{"kubectl", "get", "nodes", "-o", "json"})
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("couldn't list nodes:\n%s", output)
+	}
+	nodeList := struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Status struct {
+				Conditions []struct {
+					Type   string `json:"type"`
+					Status string `json:"status"`
+				} `json:"conditions"`
+			} `json:"status"`
+		} `json:"items"`
+	}{}
+	if err := json.Unmarshal([]byte(output), &nodeList); err != nil {
+		return fmt.Errorf("couldn't parse list of nodes\n%w", err)
+	}
+	ready := make(map[string]bool)
+	for _, node := range nodeList.Items {
+		for _, condition := range node.Status.Conditions {
+			if condition.Type == "Ready" && condition.Status == "True" {
+				ready[node.Metadata.Name] = true
+			}
+		}
+	}
+
+	// the nodes are named after their containers' hostnames, which are the container names
+	notReady := []string{}
+	for _, node := range append([]types.Container{c.Server}, c.Workers...) {
+		if name := node.Names[0][1:]; !ready[name] {
+			notReady = append(notReady, name)
+		}
+	}
+	if len(notReady) > 0 {
+		return fmt.Errorf("nodes %v aren't ready", notReady)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package k3dtest
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rancher/k3d/runtimes"
+	log "github.com/sirupsen/logrus"
+)
+
+// TestMain points $HOME to a temporary directory, since NewCluster writes the kubeconfig to ~/.config/k3d
+func TestMain(m *testing.M) {
+	home, err := ioutil.TempDir("", "k3dtest-home")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("HOME", home)
+	os.Unsetenv("KUBECONFIG")
+	log.SetOutput(ioutil.Discard)
+
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+func TestNewCluster(t *testing.T) {
+	rt := runtimes.NewFake()
+
+	var name string
+	t.Run("test using the cluster", func(t *testing.T) {
+		c := NewCluster(t, WithRuntime(rt), WithWorkers(2))
+		name = c.Name
+
+		if _, err := os.Stat(c.KubeConfigPath); err != nil {
+			t.Errorf("kubeconfig %s doesn't exist: %v", c.KubeConfigPath, err)
+		}
+		if server := rt.Container(c.ServerContainerName()); server == nil || server.State != "running" {
+			t.Errorf("server %s isn't running", c.ServerContainerName())
+		}
+		if len(c.Workers) != 2 {
+			t.Errorf("cluster has %d workers, want 2", len(c.Workers))
+		}
+	})
+
+	// the cluster is deleted when the test using it finishes
+	containers, err := rt.ListContainers(context.Background(), map[string]string{"app": "k3d", "cluster": name}, true)
+	if err != nil || len(containers) > 0 {
+		t.Errorf("containers of cluster [%s] left behind: %v (%v)", name, containers, err)
+	}
+}
+
+func TestNewClusterWaitsForReadiness(t *testing.T) {
+	rt := runtimes.NewFake()
+
+	// the API server becomes ready at the second poll, the worker at the third one
+	readyzPolls, nodesPolls := 0, 0
+	rt.ExecFunc = func(c *runtimes.FakeContainer, cmd []string) (string, int, error) {
+		switch strings.Join(cmd, " ") {
+		case "kubectl get --raw /readyz":
+			readyzPolls++
+			if readyzPolls < 2 {
+				return "[-]etcd failed: reason withheld\nreadyz check failed", 1, nil
+			}
+			return "ok", 0, nil
+		case "kubectl get nodes -o json":
+			nodesPolls++
+			workerStatus := "False"
+			if nodesPolls > 1 {
+				workerStatus = "True"
+			}
+			cluster := c.Config.Labels["cluster"]
+			return fmt.Sprintf(`{"items": [
+				{"metadata": {"name": "k3d-%s-server"}, "status": {"conditions": [{"type": "Ready", "status": "True"}]}},
+				{"metadata": {"name": "k3d-%s-worker-0"}, "status": {"conditions": [{"type": "Ready", "status": "%s"}]}}
+			]}`, cluster, cluster, workerStatus), 0, nil
+		}
+		return "", 0, nil
+	}
+
+	NewCluster(t, WithRuntime(rt), WithWorkers(1))
+
+	if readyzPolls != 3 || nodesPolls != 2 {
+		t.Errorf("NewCluster() returned after %d readyz and %d node polls, want 3 and 2", readyzPolls, nodesPolls)
+	}
+}
@@ -2,11 +2,11 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
 
 	run "github.com/rancher/k3d/cli"
 	"github.com/rancher/k3d/version"
+	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
@@ -14,6 +14,131 @@ import (
 const defaultK3sImage = "docker.io/rancher/k3s"
 const defaultK3sClusterName string = "k3s-default"
 
+// createFlags returns the flags shared by the create and run commands
+func createFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "volume, v",
+			Usage: "Mount one or more volumes into the selected nodes of the cluster (Docker notation: `source:destination[@node-specifier]`, default: all nodes)",
+		},
+		cli.StringSliceFlag{
+			Name:  "publish, add-port",
+			Usage: "Publish k3s node ports to the host (Format: `[ip:][host-port:]container-port[/protocol]@node-specifier`, use multiple options to expose more ports)",
+		},
+		cli.IntFlag{
+			Name:  "port-auto-offset",
+			Value: 0,
+			Usage: "Automatically add an offset (* worker number) to the chosen host port when using `--publish` to map the same container-port from multiple k3d workers to the host",
+		},
+		cli.StringFlag{
+			// TODO: to be deprecated
+			Name:  "version",
+			Usage: "Choose the k3s image version",
+		},
+		cli.StringFlag{
+			// TODO: only --api-port, -a soon since we want to use --port, -p for the --publish/--add-port functionality
+			Name:  "api-port, a, port, p",
+			Value: "6443",
+			Usage: "Specify the Kubernetes cluster API server port (Format: `[host:]port`, IPv6 addresses in brackets, e.g. [::1]:6443 (Note: --port/-p will be used for arbitrary port mapping as of v2.0.0, use --api-port/-a instead for setting the api port)",
+		},
+		cli.IntFlag{
+			Name:  "wait, t",
+			Value: 0, // timeout
+			Usage: "Wait for the cluster to come up before returning until timoout (in seconds). Use --wait 0 to wait forever",
+		},
+		cli.StringFlag{
+			Name:  "image, i",
+			Usage: "Specify a k3s image (Format: <repo>/<image>:<tag>)",
+			Value: fmt.Sprintf("%s:%s", defaultK3sImage, version.GetK3sVersion()),
+		},
+		cli.StringSliceFlag{
+			Name:  "server-arg, x",
+			Usage: "Pass an additional argument to k3s server (Format: `argument[@node-specifier]`, default: all servers, new flag per argument)",
+		},
+		cli.StringSliceFlag{
+			Name:  "agent-arg",
+			Usage: "Pass an additional argument to k3s agent (Format: `argument[@node-specifier]`, default: all workers, new flag per argument)",
+		},
+		cli.StringSliceFlag{
+			Name:  "env, e",
+			Usage: "Pass an additional environment variable to the selected nodes (Format: `KEY=value[@node-specifier]`, default: all nodes, new flag per variable)",
+		},
+		cli.StringSliceFlag{
+			Name:  "node-label",
+			Usage: "Add a Kubernetes label to the selected nodes (Format: `key=value@node-specifier`, default: all nodes, new flag per label)",
+		},
+		cli.StringSliceFlag{
+			Name:  "node-taint",
+			Usage: "Add a Kubernetes taint to the selected nodes (Format: `key=value:effect@node-specifier`, default: all nodes, new flag per taint)",
+		},
+		cli.StringSliceFlag{
+			Name:  "pool",
+			Usage: "Add a node pool: workers named k3d-<cluster>-<pool>-<n> with their own options (Format: `name=NAME[,count=N][,image=IMAGE][,arg=ARG][,env=KEY=VALUE][,volume=SRC:DEST][,port=PORT][,label=KEY=VALUE][,taint=KEY=VALUE:EFFECT][,memory=LIMIT][,cpus=CPUS][,pids-limit=LIMIT]`, new flag per pool)",
+		},
+		cli.StringSliceFlag{
+			Name:  "memory",
+			Usage: "Limit the memory of the selected nodes (Format: `limit[@node-specifier]`, e.g. 2g@workers, default: all nodes)",
+		},
+		cli.StringSliceFlag{
+			Name:  "cpus",
+			Usage: "Limit the number of CPUs of the selected nodes (Format: `cpus[@node-specifier]`, e.g. 1.5@server, default: all nodes)",
+		},
+		cli.StringSliceFlag{
+			Name:  "pids-limit",
+			Usage: "Limit the number of processes of the selected nodes (Format: `limit[@node-specifier]`, default: all nodes)",
+		},
+		cli.StringFlag{
+			Name:  "network",
+			Usage: "Connect the nodes to an existing (user-defined) docker network instead of creating one for the cluster",
+		},
+		cli.StringFlag{
+			Name:  "subnet",
+			Usage: "Subnet of the network created for the cluster (Format: `CIDR`, e.g. 172.28.0.0/16, default: chosen by docker)",
+		},
+		cli.StringFlag{
+			Name:  "gateway",
+			Usage: "Gateway of the network created for the cluster (requires --subnet)",
+		},
+		cli.StringFlag{
+			Name:  "ip-range",
+			Usage: "Allocate the IPs of the nodes from a part of the subnet (Format: `CIDR`, requires --subnet)",
+		},
+		cli.StringSliceFlag{
+			Name:  "ip",
+			Usage: "Assign a static IP to a single node (Format: `ip@node-specifier`, e.g. 172.28.0.10@server, new flag per node)",
+		},
+		cli.BoolFlag{
+			Name:  "ipv6",
+			Usage: "Create an IPv6 only cluster in an IPv6-enabled network (requires a k3s image with IPv6 support)",
+		},
+		cli.BoolFlag{
+			Name:  "dual-stack",
+			Usage: "Create a dual-stack cluster (IPv4 and IPv6) in an IPv6-enabled network (requires a k3s image with IPv6 support)",
+		},
+		cli.BoolFlag{
+			Name:  "network-internal",
+			Usage: "Create the cluster network without access to the outside (e.g. for airgap tests), published ports are forwarded by a proxy container and all images have to exist locally",
+		},
+		cli.IntFlag{
+			Name:  "workers, w",
+			Value: 0,
+			Usage: "Specify how many worker nodes you want to spawn",
+		},
+		cli.BoolFlag{
+			Name:  "auto-restart",
+			Usage: "Set docker's --restart=unless-stopped flag on the containers",
+		},
+		cli.StringSliceFlag{
+			Name:  "import-image",
+			Usage: "Preload an image from your local docker daemon into every node of the cluster, so it's available before workloads get scheduled (new flag per image)",
+		},
+		cli.BoolFlag{
+			Name:  "image-cache",
+			Usage: "Use the host-wide image cache shared by all k3d clusters: preloaded and imported images are stored only once per host",
+		},
+	}
+}
+
 // main represents the CLI application
 func main() {
 
@@ -62,79 +187,61 @@ func main() {
 				cli.StringFlag{
 					Name:  "shell, s",
 					Value: "auto",
-					Usage: "which shell to use. One of [auto, bash, zsh]",
+					Usage: "which shell to use. One of [auto, bash, zsh, fish, sh]",
 				},
 			},
+			Before: run.UseCurrentCluster,
 			Action: run.Shell,
 		},
 		{
-			// create creates a new k3s cluster in docker containers
-			Name:    "create",
-			Aliases: []string{"c"},
-			Usage:   "Create a single- or multi-node k3s cluster in docker containers",
+			// env prints the environment variables to use a cluster from the current shell
+			Name:  "env",
+			Usage: "Print the shell commands to use a cluster in the current shell (eval \"$(k3d env)\")",
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:  "name, n",
 					Value: defaultK3sClusterName,
-					Usage: "Set a name for the cluster",
-				},
-				cli.StringSliceFlag{
-					Name:  "volume, v",
-					Usage: "Mount one or more volumes into every node of the cluster (Docker notation: `source:destination`)",
-				},
-				cli.StringSliceFlag{
-					Name:  "publish, add-port",
-					Usage: "Publish k3s node ports to the host (Format: `[ip:][host-port:]container-port[/protocol]@node-specifier`, use multiple options to expose more ports)",
-				},
-				cli.IntFlag{
-					Name:  "port-auto-offset",
-					Value: 0,
-					Usage: "Automatically add an offset (* worker number) to the chosen host port when using `--publish` to map the same container-port from multiple k3d workers to the host",
+					Usage: "Name of the cluster",
 				},
 				cli.StringFlag{
-					// TODO: to be deprecated
-					Name:  "version",
-					Usage: "Choose the k3s image version",
+					Name:  "shell, s",
+					Value: "auto",
+					Usage: "which shell to print the commands for. One of [auto, bash, zsh, fish, sh, posix]",
 				},
+			},
+			Before: run.UseCurrentCluster,
+			Action: run.Env,
+		},
+		{
+			// create creates a new k3s cluster in docker containers
+			Name:    "create",
+			Aliases: []string{"c"},
+			Usage:   "Create a single- or multi-node k3s cluster in docker containers",
+			Flags: append([]cli.Flag{
 				cli.StringFlag{
-					// TODO: only --api-port, -a soon since we want to use --port, -p for the --publish/--add-port functionality
-					Name:  "api-port, a, port, p",
-					Value: "6443",
-					Usage: "Specify the Kubernetes cluster API server port (Format: `[host:]port` (Note: --port/-p will be used for arbitrary port mapping as of v2.0.0, use --api-port/-a instead for setting the api port)",
-				},
-				cli.IntFlag{
-					Name:  "wait, t",
-					Value: 0, // timeout
-					Usage: "Wait for the cluster to come up before returning until timoout (in seconds). Use --wait 0 to wait forever",
+					Name:  "name, n",
+					Value: defaultK3sClusterName,
+					Usage: "Set a name for the cluster",
 				},
+			}, createFlags()...),
+			Action: run.CreateCluster,
+		},
+		{
+			// run creates a temporary cluster, runs a command against it and deletes the cluster again
+			Name:      "run",
+			Usage:     "Create a temporary cluster, run a command with KUBECONFIG pointing to it and delete the cluster again",
+			ArgsUsage: "-- COMMAND [ARG...]",
+			Flags: append([]cli.Flag{
 				cli.StringFlag{
-					Name:  "image, i",
-					Usage: "Specify a k3s image (Format: <repo>/<image>:<tag>)",
-					Value: fmt.Sprintf("%s:%s", defaultK3sImage, version.GetK3sVersion()),
-				},
-				cli.StringSliceFlag{
-					Name:  "server-arg, x",
-					Usage: "Pass an additional argument to k3s server (new flag per argument)",
-				},
-				cli.StringSliceFlag{
-					Name:  "agent-arg",
-					Usage: "Pass an additional argument to k3s agent (new flag per argument)",
-				},
-				cli.StringSliceFlag{
-					Name:  "env, e",
-					Usage: "Pass an additional environment variable (new flag per variable)",
-				},
-				cli.IntFlag{
-					Name:  "workers, w",
-					Value: 0,
-					Usage: "Specify how many worker nodes you want to spawn",
+					Name:  "name, n",
+					Usage: "Set a name for the cluster (default: random)",
 				},
 				cli.BoolFlag{
-					Name:  "auto-restart",
-					Usage: "Set docker's --restart=unless-stopped flag on the containers",
+					Name:  "keep-on-failure",
+					Usage: "Don't delete the cluster if the command fails, e.g. for debugging",
 				},
-			},
-			Action: run.CreateCluster,
+			}, createFlags()...),
+			Action: run.RunCluster,
 		},
 		{
 			// delete deletes an existing k3s cluster (remove container and cluster directory)
@@ -152,6 +259,7 @@ func main() {
 					Usage: "Delete all existing clusters (this ignores the --name/-n flag)",
 				},
 			},
+			Before: run.UseCurrentCluster,
 			Action: run.DeleteCluster,
 		},
 		{
@@ -169,6 +277,7 @@ func main() {
 					Usage: "Stop all running clusters (this ignores the --name/-n flag)",
 				},
 			},
+			Before: run.UseCurrentCluster,
 			Action: run.StopCluster,
 		},
 		{
@@ -186,6 +295,7 @@ func main() {
 					Usage: "Start all stopped clusters (this ignores the --name/-n flag)",
 				},
 			},
+			Before: run.UseCurrentCluster,
 			Action: run.StartCluster,
 		},
 		{
@@ -198,9 +308,20 @@ func main() {
 					Name:  "all, a",
 					Usage: "Also show non-running clusters",
 				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "Output format (wide additionally shows the resource limits of the nodes)",
+				},
 			},
 			Action: run.ListClusters,
 		},
+		{
+			// use selects the cluster that other commands run against if --name is not given
+			Name:      "use",
+			Usage:     "Select the cluster to use if no --name is given and switch the kubeconfig context to it",
+			ArgsUsage: "[CLUSTER]",
+			Action:    run.UseCluster,
+		},
 		{
 			// get-kubeconfig grabs the kubeconfig from the cluster and prints the path to it
 			Name:  "get-kubeconfig",
@@ -213,11 +334,72 @@ func main() {
 				},
 				cli.BoolFlag{
 					Name:  "all, a",
-					Usage: "Get kubeconfig for all clusters (this ignores the --name/-n flag)",
+					Usage: "Get kubeconfig for all clusters (this ignores the --name/-n flag). Prints one path per cluster or, with --merge, the path of the merged kubeconfig",
+				},
+				cli.BoolFlag{
+					Name:  "overwrite",
+					Usage: "Regenerate the kubeconfig file even if it looks up to date",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "Write the kubeconfig to this path instead of the cluster directory (`-` for stdout)",
+				},
+				cli.BoolFlag{
+					Name:  "internal",
+					Usage: "Get a kubeconfig for containers in the cluster network, which points to the server container (k3d-<name>-server) instead of the host",
+				},
+				cli.BoolFlag{
+					Name:  "merge, m",
+					Usage: "Merge the cluster into your kubeconfig (see --kubeconfig) as k3d-<name> instead of writing a separate file",
+				},
+				cli.BoolFlag{
+					Name:  "switch-context, s",
+					Usage: "Make k3d-<name> the current context of the merged kubeconfig (implies --merge)",
+				},
+				cli.StringFlag{
+					Name:  "kubeconfig",
+					Usage: "Kubeconfig file to merge the cluster into (implies --merge). Defaults to $KUBECONFIG or ~/.kube/config",
 				},
 			},
+			Before: run.UseCurrentCluster,
 			Action: run.GetKubeConfig,
 		},
+		{
+			// kubeconfig manages additional kubeconfigs for a cluster
+			Name:  "kubeconfig",
+			Usage: "Manage kubeconfigs for additional users of a cluster",
+			Subcommands: []cli.Command{
+				{
+					Name:  "create-user",
+					Usage: "Create a kubeconfig for a user authenticating with a client certificate signed by the cluster's client CA",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "name, n",
+							Value: defaultK3sClusterName,
+							Usage: "Name of the cluster",
+						},
+						cli.StringFlag{
+							Name:  "user, u",
+							Usage: "Name of the user (common name of the client certificate)",
+						},
+						cli.StringSliceFlag{
+							Name:  "group, g",
+							Usage: "Group of the user (organization of the client certificate, new flag per group)",
+						},
+						cli.StringFlag{
+							Name:  "clusterrole",
+							Usage: "Bind the user to this cluster role, e.g. `view` (no binding is created by default)",
+						},
+						cli.StringFlag{
+							Name:  "output, o",
+							Usage: "Write the kubeconfig to this path instead of the cluster directory (`-` for stdout)",
+						},
+					},
+					Before: run.UseCurrentCluster,
+					Action: run.CreateUser,
+				},
+			},
+		},
 		{
 			// get-kubeconfig grabs the kubeconfig from the cluster and prints the path to it
 			Name:    "import-images",
@@ -234,21 +416,101 @@ func main() {
 					Usage: "Disable automatic removal of the tarball",
 				},
 			},
+			Before: run.UseCurrentCluster,
 			Action: run.ImportImage,
 		},
+		{
+			// images manages the images in the containerd image store of the cluster nodes
+			Name:  "images",
+			Usage: "Manage the container images inside the nodes of a cluster",
+			Subcommands: []cli.Command{
+				{
+					Name:    "list",
+					Aliases: []string{"ls", "l"},
+					Usage:   "List the images in the cluster nodes with their size and the nodes that have them",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "name, n, cluster, c",
+							Value: defaultK3sClusterName,
+							Usage: "Name of the cluster",
+						},
+					},
+					Before: run.UseCurrentCluster,
+					Action: run.ListImages,
+				},
+				{
+					Name:      "rm",
+					Aliases:   []string{"remove", "delete"},
+					Usage:     "Remove images from all nodes of the cluster",
+					ArgsUsage: "IMAGE [IMAGE...]",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "name, n, cluster, c",
+							Value: defaultK3sClusterName,
+							Usage: "Name of the cluster",
+						},
+					},
+					Before: run.UseCurrentCluster,
+					Action: run.RemoveImages,
+				},
+				{
+					Name:      "export",
+					Usage:     "Export an image from the cluster nodes into a tarball or into the local docker daemon",
+					ArgsUsage: "IMAGE",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "name, n, cluster, c",
+							Value: defaultK3sClusterName,
+							Usage: "Name of the cluster",
+						},
+						cli.StringFlag{
+							Name:  "output, o",
+							Usage: "Write the image to a tarball at this path instead of loading it into the local docker daemon",
+						},
+					},
+					Before: run.UseCurrentCluster,
+					Action: run.ExportImage,
+				},
+			},
+		},
 	}
 
 	// Global flags
 	app.Flags = []cli.Flag{
 		cli.BoolFlag{
 			Name:  "verbose",
-			Usage: "Enable verbose output",
+			Usage: "Enable verbose output (debug logs and image pull progress)",
+		},
+		cli.StringFlag{
+			Name:   "log-level",
+			Value:  "info",
+			Usage:  "Log level (debug, info, warn or error)",
+			EnvVar: "K3D_LOG_LEVEL",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Value:  "text",
+			Usage:  "Log format (text or json)",
+			EnvVar: "K3D_LOG_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "runtime",
+			Usage:  "Container runtime to run the cluster in (docker or podman, default: podman if only its API socket is found, docker otherwise)",
+			EnvVar: "K3D_RUNTIME",
+		},
+		cli.DurationFlag{
+			Name:   "timeout",
+			Usage:  "Cancel the command if it takes longer than this (e.g. 30s or 5m, 0 means no timeout)",
+			EnvVar: "K3D_TIMEOUT",
 		},
 	}
 
+	app.Before = run.SetupLogging
+
 	// run the whole thing
 	err := app.Run(os.Args)
 	if err != nil {
-		log.Fatal(err)
+		log.Error(err)
+		os.Exit(run.ExitCode(err))
 	}
 }
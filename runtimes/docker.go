@@ -0,0 +1,221 @@
+package runtimes
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+)
+
+// defaultDockerSocket is the path of the docker API socket, unless DOCKER_HOST says otherwise
+const defaultDockerSocket = "/var/run/docker.sock"
+
+// Docker is the Runtime talking to a docker daemon (configured via the DOCKER_* environment variables)
+type Docker struct {
+	client *client.Client
+}
+
+// NewDocker creates a docker client from the environment
+func NewDocker() (*Docker, error) {
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create docker client\n%+v\n%w", err, ErrUnavailable)
+	}
+	return &Docker{client: docker}, nil
+}
+
+// labelFilters turns a set of labels into docker label filters
+func labelFilters(labels map[string]string) filters.Args {
+	args := filters.NewArgs()
+	for key, value := range labels {
+		args.Add("label", fmt.Sprintf("%s=%s", key, value))
+	}
+	return args
+}
+
+func (d *Docker) CreateContainer(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (string, error) {
+	resp, err := d.client.ContainerCreate(ctx, config, hostConfig, networkingConfig, name)
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+func (d *Docker) StartContainer(ctx context.Context, id string) error {
+	return d.client.ContainerStart(ctx, id, types.ContainerStartOptions{})
+}
+
+func (d *Docker) StopContainer(ctx context.Context, id string) error {
+	return d.client.ContainerStop(ctx, id, nil)
+}
+
+func (d *Docker) RemoveContainer(ctx context.Context, id string) error {
+	return d.client.ContainerRemove(ctx, id, types.ContainerRemoveOptions{
+		RemoveVolumes: true,
+		Force:         true,
+	})
+}
+
+func (d *Docker) InspectContainer(ctx context.Context, id string) (types.ContainerJSON, error) {
+	return d.client.ContainerInspect(ctx, id)
+}
+
+func (d *Docker) ListContainers(ctx context.Context, labels map[string]string, all bool) ([]types.Container, error) {
+	return d.client.ContainerList(ctx, types.ContainerListOptions{
+		All:     all,
+		Filters: labelFilters(labels),
+	})
+}
+
+func (d *Docker) ContainerLogs(ctx context.Context, id string) (io.ReadCloser, error) {
+	return d.client.ContainerLogs(ctx, id, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
+}
+
+func (d *Docker) Exec(ctx context.Context, id string, cmd []string) (string, int, error) {
+	execResponse, err := d.client.ContainerExecCreate(ctx, id, types.ExecConfig{
+		AttachStderr: true,
+		AttachStdout: true,
+		Cmd:          cmd,
+		Tty:          true,
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("Failed to create exec command %s for container [%s]\n%+v", cmd, id, err)
+	}
+
+	// attaching starts the exec process
+	containerConnection, err := d.client.ContainerExecAttach(ctx, execResponse.ID, types.ExecStartCheck{
+		Tty: true,
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("couldn't attach to container [%s]\n%+v", id, err)
+	}
+	defer containerConnection.Close()
+
+	output, err := ioutil.ReadAll(containerConnection.Reader)
+	if err != nil {
+		return "", 0, fmt.Errorf("couldn't read output from container [%s]\n%+v", id, err)
+	}
+
+	// the output stream might be closed before the exec process is reported as finished
+	for {
+		execInspect, err := d.client.ContainerExecInspect(ctx, execResponse.ID)
+		if err != nil {
+			return "", 0, fmt.Errorf("couldn't get exit code of command %s in container [%s]\n%+v", cmd, id, err)
+		}
+		if !execInspect.Running {
+			return string(output), execInspect.ExitCode, nil
+		}
+		time.Sleep(time.Second / 10)
+	}
+}
+
+func (d *Docker) CopyFromContainer(ctx context.Context, id, srcPath string) (io.ReadCloser, error) {
+	reader, _, err := d.client.CopyFromContainer(ctx, id, srcPath)
+	return reader, err
+}
+
+func (d *Docker) CreateNetwork(ctx context.Context, name string, options types.NetworkCreate) (string, error) {
+	resp, err := d.client.NetworkCreate(ctx, name, options)
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+func (d *Docker) ListNetworks(ctx context.Context, labels map[string]string) ([]types.NetworkResource, error) {
+	return d.client.NetworkList(ctx, types.NetworkListOptions{Filters: labelFilters(labels)})
+}
+
+func (d *Docker) RemoveNetwork(ctx context.Context, id string) error {
+	return d.client.NetworkRemove(ctx, id)
+}
+
+func (d *Docker) ConnectNetwork(ctx context.Context, networkID, containerID string, aliases []string) error {
+	return d.client.NetworkConnect(ctx, networkID, containerID, &network.EndpointSettings{Aliases: aliases})
+}
+
+func (d *Docker) CreateVolume(ctx context.Context, options volume.VolumeCreateBody) (types.Volume, error) {
+	return d.client.VolumeCreate(ctx, options)
+}
+
+func (d *Docker) ListVolumes(ctx context.Context, labels map[string]string) ([]*types.Volume, error) {
+	volumeList, err := d.client.VolumeList(ctx, labelFilters(labels))
+	if err != nil {
+		return nil, err
+	}
+	return volumeList.Volumes, nil
+}
+
+func (d *Docker) RemoveVolume(ctx context.Context, name string) error {
+	return d.client.VolumeRemove(ctx, name, true)
+}
+
+func (d *Docker) ImageExists(ctx context.Context, image string) (bool, error) {
+	if _, _, err := d.client.ImageInspectWithRaw(ctx, image); err != nil {
+		if client.IsErrNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *Docker) ImageID(ctx context.Context, image string) (string, error) {
+	inspect, _, err := d.client.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return "", err
+	}
+	return inspect.ID, nil
+}
+
+func (d *Docker) PullImage(ctx context.Context, image string, output io.Writer) error {
+	reader, err := d.client.ImagePull(ctx, image, types.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(output, reader)
+	return err
+}
+
+func (d *Docker) LoadImage(ctx context.Context, input io.Reader, output io.Writer) error {
+	resp, err := d.client.ImageLoad(ctx, input, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(output, resp.Body)
+	return err
+}
+
+func (d *Docker) Ping(ctx context.Context) (types.Ping, error) {
+	return d.client.Ping(ctx)
+}
+
+func (d *Docker) Info(ctx context.Context) (types.Info, error) {
+	return d.client.Info(ctx)
+}
+
+// SocketPath returns the socket from DOCKER_HOST or the default one, if the daemon isn't reached via a unix socket
+func (d *Docker) SocketPath() string {
+	if host := d.client.DaemonHost(); strings.HasPrefix(host, "unix://") {
+		return strings.TrimPrefix(host, "unix://")
+	}
+	return defaultDockerSocket
+}
+
+// SupportsRestartPolicy returns true, since the docker daemon restarts the containers (e.g. after a reboot)
+func (d *Docker) SupportsRestartPolicy() bool {
+	return true
+}
+
+var _ Runtime = &Docker{}
@@ -0,0 +1,626 @@
+package runtimes
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+)
+
+// Fake is an in-memory Runtime for tests. It keeps track of containers, networks, volumes and images
+// without running anything, but behaves like k3d expects the nodes to behave:
+// k3s servers report to be up ("Running kubelet"), write a kubeconfig to /output/kubeconfig.yaml and
+// answer kubectl with a ready API server and ready nodes, while the k3d tools containers exit successfully
+// right after they were started.
+type Fake struct {
+	// ExecFunc is called for every command run in a container. By default, commands succeed without output
+	// (except for kubectl in servers, see Fake).
+	ExecFunc func(container *FakeContainer, cmd []string) (string, int, error)
+	// HostInfo is returned by Info (default: 4 CPUs and 8 GiB of memory)
+	HostInfo types.Info
+
+	mu         sync.Mutex
+	nextID     int
+	containers map[string]*FakeContainer
+	networks   map[string]*types.NetworkResource
+	volumes    map[string]*types.Volume
+	images     map[string]string
+}
+
+// FakeContainer is a container of the Fake runtime
+type FakeContainer struct {
+	ID               string
+	Name             string
+	Config           container.Config
+	HostConfig       container.HostConfig
+	NetworkingConfig network.NetworkingConfig
+	State            string
+	ExitCode         int
+	Logs             string
+	// Files maps absolute paths to the contents of the files in the container (see CopyFromContainer)
+	Files   map[string][]byte
+	Created time.Time
+}
+
+type fakeNotFoundError struct {
+	object string
+	id     string
+}
+
+func (e fakeNotFoundError) Error() string {
+	return fmt.Sprintf("Error: No such %s: %s", e.object, e.id)
+}
+
+// NotFound marks the error as a not found error (see IsErrNotFound)
+func (e fakeNotFoundError) NotFound() {}
+
+// NewFake creates an empty Fake runtime
+func NewFake() *Fake {
+	return &Fake{
+		HostInfo:   types.Info{NCPU: 4, MemTotal: 8 << 30},
+		containers: make(map[string]*FakeContainer),
+		networks:   make(map[string]*types.NetworkResource),
+		volumes:    make(map[string]*types.Volume),
+		images:     make(map[string]string),
+	}
+}
+
+func (f *Fake) newID() string {
+	f.nextID++
+	return fmt.Sprintf("%064x", f.nextID)
+}
+
+// hasLabels checks whether all the wanted labels are set
+func hasLabels(labels, wanted map[string]string) bool {
+	for key, value := range wanted {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Container returns the container with the given ID or name (or nil)
+func (f *Fake) Container(idOrName string) *FakeContainer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lookupContainer(idOrName)
+}
+
+func (f *Fake) lookupContainer(idOrName string) *FakeContainer {
+	if c, ok := f.containers[idOrName]; ok {
+		return c
+	}
+	for _, c := range f.containers {
+		if c.Name == idOrName {
+			return c
+		}
+	}
+	return nil
+}
+
+// Images returns the names of the images in the image store of the fake runtime
+func (f *Fake) Images() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	images := []string{}
+	for image := range f.images {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	return images
+}
+
+func (f *Fake) CreateContainer(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.images[config.Image]; !ok {
+		return "", fakeNotFoundError{"image", config.Image}
+	}
+	if name != "" && f.lookupContainer(name) != nil {
+		return "", fmt.Errorf("Conflict. The container name \"/%s\" is already in use", name)
+	}
+	for networkName := range networkingConfig.EndpointsConfig {
+		if f.lookupNetwork(networkName) == nil {
+			return "", fakeNotFoundError{"network", networkName}
+		}
+	}
+
+	id := f.newID()
+	if name == "" {
+		name = "fake-" + id[len(id)-12:]
+	}
+	f.containers[id] = &FakeContainer{
+		ID:               id,
+		Name:             name,
+		Config:           *config,
+		HostConfig:       *hostConfig,
+		NetworkingConfig: *networkingConfig,
+		State:            "created",
+		Files:            make(map[string][]byte),
+		Created:          time.Now(),
+	}
+	return id, nil
+}
+
+func (f *Fake) StartContainer(ctx context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := f.lookupContainer(id)
+	if c == nil {
+		return fakeNotFoundError{"container", id}
+	}
+	c.State = "running"
+
+	if c.Config.Labels["component"] == "tools" {
+		c.State = "exited"
+		c.ExitCode = 0
+	}
+	if len(c.Config.Cmd) > 0 && c.Config.Cmd[0] == "server" {
+		c.Logs += "Running kubelet\n"
+		c.Files["/output/kubeconfig.yaml"] = fakeKubeConfig(c.Config.Cmd)
+	}
+	return nil
+}
+
+// fakeKubeConfig generates a kubeconfig like the one that k3s writes, using the --https-listen-port argument
+func fakeKubeConfig(cmd []string) []byte {
+	port := "6443"
+	for i, arg := range cmd {
+		if arg == "--https-listen-port" && i+1 < len(cmd) {
+			port = cmd[i+1]
+		}
+	}
+	return []byte(fmt.Sprintf(`apiVersion: v1
+clusters:
+- cluster:
+    certificate-authority-data: ZmFrZQ==
+    server: https://localhost:%s
+  name: default
+contexts:
+- context:
+    cluster: default
+    user: default
+  name: default
+current-context: default
+kind: Config
+preferences: {}
+users:
+- name: default
+  user:
+    password: fake
+    username: admin
+`, port))
+}
+
+func (f *Fake) StopContainer(ctx context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := f.lookupContainer(id)
+	if c == nil {
+		return fakeNotFoundError{"container", id}
+	}
+	c.State = "exited"
+	return nil
+}
+
+func (f *Fake) RemoveContainer(ctx context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := f.lookupContainer(id)
+	if c == nil {
+		return fakeNotFoundError{"container", id}
+	}
+	delete(f.containers, c.ID)
+	return nil
+}
+
+func (f *Fake) InspectContainer(ctx context.Context, id string) (types.ContainerJSON, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := f.lookupContainer(id)
+	if c == nil {
+		return types.ContainerJSON{}, fakeNotFoundError{"container", id}
+	}
+	hostConfig := c.HostConfig
+	config := c.Config
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:      c.ID,
+			Name:    "/" + c.Name,
+			Created: c.Created.Format(time.RFC3339Nano),
+			State: &types.ContainerState{
+				Status:   c.State,
+				Running:  c.State == "running",
+				ExitCode: c.ExitCode,
+			},
+			HostConfig: &hostConfig,
+		},
+		Config: &config,
+	}, nil
+}
+
+// toContainer returns the container the way it's listed by the docker API
+func (c *FakeContainer) toContainer() types.Container {
+	listed := types.Container{
+		ID:      c.ID,
+		Names:   []string{"/" + c.Name},
+		Image:   c.Config.Image,
+		Labels:  c.Config.Labels,
+		State:   c.State,
+		Created: c.Created.Unix(),
+	}
+	for port, bindings := range c.HostConfig.PortBindings {
+		for _, binding := range bindings {
+			publicPort, _ := strconv.Atoi(binding.HostPort)
+			listed.Ports = append(listed.Ports, types.Port{
+				IP:          binding.HostIP,
+				PrivatePort: uint16(port.Int()),
+				PublicPort:  uint16(publicPort),
+				Type:        port.Proto(),
+			})
+		}
+	}
+	for _, bind := range c.HostConfig.Binds {
+		split := strings.Split(bind, ":")
+		if len(split) < 2 {
+			continue
+		}
+		mount := types.MountPoint{Source: split[0], Destination: split[1]}
+		if !strings.HasPrefix(split[0], "/") {
+			mount.Type = "volume"
+			mount.Name = split[0]
+		} else {
+			mount.Type = "bind"
+		}
+		listed.Mounts = append(listed.Mounts, mount)
+	}
+	return listed
+}
+
+func (f *Fake) ListContainers(ctx context.Context, labels map[string]string, all bool) ([]types.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	containers := []types.Container{}
+	for _, c := range f.containers {
+		if !hasLabels(c.Config.Labels, labels) || (!all && c.State != "running") {
+			continue
+		}
+		containers = append(containers, c.toContainer())
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].Names[0] < containers[j].Names[0] })
+	return containers, nil
+}
+
+func (f *Fake) ContainerLogs(ctx context.Context, id string) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := f.lookupContainer(id)
+	if c == nil {
+		return nil, fakeNotFoundError{"container", id}
+	}
+	return ioutil.NopCloser(strings.NewReader(c.Logs)), nil
+}
+
+func (f *Fake) Exec(ctx context.Context, id string, cmd []string) (string, int, error) {
+	f.mu.Lock()
+	c := f.lookupContainer(id)
+	f.mu.Unlock()
+
+	if c == nil {
+		return "", 0, fakeNotFoundError{"container", id}
+	}
+	if c.State != "running" {
+		return "", 0, fmt.Errorf("Container %s is not running", id)
+	}
+	if f.ExecFunc != nil {
+		return f.ExecFunc(c, cmd)
+	}
+	if len(c.Config.Cmd) > 0 && c.Config.Cmd[0] == "server" && len(cmd) > 0 && cmd[0] == "kubectl" {
+		return f.kubectl(c, cmd[1:])
+	}
+	return "", 0, nil
+}
+
+// kubectl answers the kubectl commands run in a server like a cluster whose API server and nodes are ready:
+// `get --raw /readyz` and `get nodes -o json` (listing the running nodes of the server's cluster)
+func (f *Fake) kubectl(server *FakeContainer, args []string) (string, int, error) {
+	switch strings.Join(args, " ") {
+	case "get --raw /readyz":
+		return "ok", 0, nil
+	case "get nodes -o json":
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		type condition struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		}
+		type node struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Status struct {
+				Conditions []condition `json:"conditions"`
+			} `json:"status"`
+		}
+		nodes := []node{}
+		for _, c := range f.containers {
+			component := c.Config.Labels["component"]
+			if c.Config.Labels["cluster"] != server.Config.Labels["cluster"] || (component != "server" && component != "worker") || c.State != "running" {
+				continue
+			}
+			n := node{}
+			n.Metadata.Name = c.Config.Hostname
+			n.Status.Conditions = []condition{{Type: "Ready", Status: "True"}}
+			nodes = append(nodes, n)
+		}
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].Metadata.Name < nodes[j].Metadata.Name })
+		output, err := json.Marshal(map[string]interface{}{"kind": "List", "items": nodes})
+		return string(output), 0, err
+	}
+	return "", 0, nil
+}
+
+func (f *Fake) CopyFromContainer(ctx context.Context, id, srcPath string) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := f.lookupContainer(id)
+	if c == nil {
+		return nil, fakeNotFoundError{"container", id}
+	}
+
+	// like docker, "<dir>/." copies the contents of the directory
+	dir := strings.TrimSuffix(srcPath, "/.")
+	copyDir := dir != srcPath
+
+	buf := new(bytes.Buffer)
+	tarWriter := tar.NewWriter(buf)
+	found := false
+	for filePath, content := range c.Files {
+		var name string
+		switch {
+		case filePath == srcPath:
+			name = path.Base(filePath)
+		case copyDir && strings.HasPrefix(filePath, dir+"/"):
+			name = strings.TrimPrefix(filePath, dir+"/")
+		default:
+			continue
+		}
+		found = true
+		if err := tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			return nil, err
+		}
+		if _, err := tarWriter.Write(content); err != nil {
+			return nil, err
+		}
+	}
+	if !found && !copyDir {
+		return nil, fakeNotFoundError{"file", srcPath}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(buf), nil
+}
+
+func (f *Fake) lookupNetwork(idOrName string) *types.NetworkResource {
+	if n, ok := f.networks[idOrName]; ok {
+		return n
+	}
+	for _, n := range f.networks {
+		if n.Name == idOrName {
+			return n
+		}
+	}
+	return nil
+}
+
+func (f *Fake) CreateNetwork(ctx context.Context, name string, options types.NetworkCreate) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.lookupNetwork(name) != nil {
+		return "", fmt.Errorf("network with name %s already exists", name)
+	}
+	driver := options.Driver
+	if driver == "" {
+		driver = "bridge"
+	}
+	id := f.newID()
+	ipam := network.IPAM{}
+	if options.IPAM != nil {
+		ipam = *options.IPAM
+	}
+	f.networks[id] = &types.NetworkResource{
+		ID:         id,
+		Name:       name,
+		Driver:     driver,
+		Labels:     options.Labels,
+		Internal:   options.Internal,
+		EnableIPv6: options.EnableIPv6,
+		IPAM:       ipam,
+		Options:    options.Options,
+	}
+	return id, nil
+}
+
+func (f *Fake) ListNetworks(ctx context.Context, labels map[string]string) ([]types.NetworkResource, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	networks := []types.NetworkResource{}
+	for _, n := range f.networks {
+		if hasLabels(n.Labels, labels) {
+			networks = append(networks, *n)
+		}
+	}
+	sort.Slice(networks, func(i, j int) bool { return networks[i].Name < networks[j].Name })
+	return networks, nil
+}
+
+func (f *Fake) RemoveNetwork(ctx context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := f.lookupNetwork(id)
+	if n == nil {
+		return fakeNotFoundError{"network", id}
+	}
+	for _, c := range f.containers {
+		if _, attached := c.NetworkingConfig.EndpointsConfig[n.Name]; attached {
+			return fmt.Errorf("error while removing network: network %s has active endpoints", n.Name)
+		}
+	}
+	delete(f.networks, n.ID)
+	return nil
+}
+
+// ConnectNetwork adds the network to the networking config of the container
+func (f *Fake) ConnectNetwork(ctx context.Context, networkID, containerID string, aliases []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := f.lookupNetwork(networkID)
+	if n == nil {
+		return fakeNotFoundError{"network", networkID}
+	}
+	c := f.lookupContainer(containerID)
+	if c == nil {
+		return fakeNotFoundError{"container", containerID}
+	}
+	if c.NetworkingConfig.EndpointsConfig == nil {
+		c.NetworkingConfig.EndpointsConfig = make(map[string]*network.EndpointSettings)
+	}
+	c.NetworkingConfig.EndpointsConfig[n.Name] = &network.EndpointSettings{Aliases: aliases}
+	return nil
+}
+
+func (f *Fake) CreateVolume(ctx context.Context, options volume.VolumeCreateBody) (types.Volume, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// like docker, creating an existing volume returns the existing one
+	if v, ok := f.volumes[options.Name]; ok {
+		return *v, nil
+	}
+	name := options.Name
+	if name == "" {
+		name = f.newID()
+	}
+	f.volumes[name] = &types.Volume{
+		Name:    name,
+		Driver:  options.Driver,
+		Labels:  options.Labels,
+		Options: options.DriverOpts,
+		Scope:   "local",
+	}
+	return *f.volumes[name], nil
+}
+
+func (f *Fake) ListVolumes(ctx context.Context, labels map[string]string) ([]*types.Volume, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	volumes := []*types.Volume{}
+	for _, v := range f.volumes {
+		if hasLabels(v.Labels, labels) {
+			listed := *v
+			volumes = append(volumes, &listed)
+		}
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+	return volumes, nil
+}
+
+func (f *Fake) RemoveVolume(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.volumes[name]; !ok {
+		return fakeNotFoundError{"volume", name}
+	}
+	delete(f.volumes, name)
+	return nil
+}
+
+func (f *Fake) ImageExists(ctx context.Context, image string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.images[image]
+	return ok, nil
+}
+
+func (f *Fake) ImageID(ctx context.Context, image string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id, ok := f.images[image]
+	if !ok {
+		return "", fakeNotFoundError{"image", image}
+	}
+	return id, nil
+}
+
+// PullImage adds the image to the image store of the fake runtime. Like a rebuilt image,
+// an image which is pulled again gets a new ID.
+func (f *Fake) PullImage(ctx context.Context, image string, output io.Writer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.images[image] = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(f.newID())))
+	_, err := fmt.Fprintf(output, "Pulled %s\n", image)
+	return err
+}
+
+// LoadImage reads the tarball, but doesn't add anything to the image store of the fake runtime
+func (f *Fake) LoadImage(ctx context.Context, input io.Reader, output io.Writer) error {
+	if _, err := io.Copy(ioutil.Discard, input); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(output, "Loaded image")
+	return err
+}
+
+func (f *Fake) Ping(ctx context.Context) (types.Ping, error) {
+	return types.Ping{APIVersion: "fake"}, nil
+}
+
+func (f *Fake) Info(ctx context.Context) (types.Info, error) {
+	return f.HostInfo, nil
+}
+
+func (f *Fake) SocketPath() string {
+	return "/var/run/docker.sock"
+}
+
+// SupportsRestartPolicy returns true like docker (the fake doesn't restart any containers, though)
+func (f *Fake) SupportsRestartPolicy() bool {
+	return true
+}
+
+var _ Runtime = &Fake{}
@@ -0,0 +1,164 @@
+package runtimes
+
+/*
+ * Podman serves a Docker-compatible API on its socket, so the Podman runtime re-uses the docker client
+ * and only takes care of the differences in behavior between podman and docker.
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+// Podman is the Runtime talking to podman's Docker-compatible API socket
+type Podman struct {
+	Docker
+	socket string
+}
+
+// podmanSocketPaths returns the paths that the podman API socket is looked up at:
+// the socket of the rootless podman service of the current user and the one of the system-wide service
+func podmanSocketPaths() []string {
+	paths := []string{}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		paths = append(paths, path.Join(runtimeDir, "podman", "podman.sock"))
+	}
+	return append(paths, "/run/podman/podman.sock")
+}
+
+// findPodmanSocket returns the path of the first podman API socket that exists (or an empty string)
+func findPodmanSocket() string {
+	for _, socket := range podmanSocketPaths() {
+		if _, err := os.Stat(socket); err == nil {
+			return socket
+		}
+	}
+	return ""
+}
+
+// NewPodman creates a client for the podman API socket (see podmanSocketPaths)
+func NewPodman() (*Podman, error) {
+	socket := findPodmanSocket()
+	if socket == "" {
+		return nil, fmt.Errorf("couldn't find the podman API socket at %s, please start it with `systemctl --user start podman.socket`\n%w", strings.Join(podmanSocketPaths(), " or "), ErrUnavailable)
+	}
+	podman, err := client.NewClientWithOpts(client.WithHost("unix://"+socket), client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create podman client\n%+v\n%w", err, ErrUnavailable)
+	}
+	return &Podman{Docker: Docker{client: podman}, socket: socket}, nil
+}
+
+// errRestartPolicyUnsupported is returned for containers with a restart policy, see SupportsRestartPolicy
+var errRestartPolicyUnsupported = errors.New("restart policies are not supported with podman, since there is no daemon restarting the containers")
+
+// SupportsRestartPolicy returns false, since podman can't restart containers without a daemon
+func (p *Podman) SupportsRestartPolicy() bool {
+	return false
+}
+
+// CreateContainer rejects restart policies, since there is no daemon that would restart the containers after a reboot
+// and lets privileged containers use the host's cgroup namespace like docker does (k3s needs it to manage the pod cgroups)
+func (p *Podman) CreateContainer(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (string, error) {
+	if hostConfig != nil {
+		if hostConfig.RestartPolicy.Name != "" && hostConfig.RestartPolicy.Name != "no" {
+			return "", errRestartPolicyUnsupported
+		}
+		if hostConfig.Privileged && hostConfig.CgroupnsMode == "" {
+			hostConfig.CgroupnsMode = "host"
+		}
+	}
+	return p.Docker.CreateContainer(ctx, config, hostConfig, networkingConfig, name)
+}
+
+// ListContainers filters the containers by label on the client side, since podman doesn't combine multiple label filters
+func (p *Podman) ListContainers(ctx context.Context, labels map[string]string, all bool) ([]types.Container, error) {
+	containers, err := p.client.ContainerList(ctx, types.ContainerListOptions{All: all})
+	if err != nil {
+		return nil, err
+	}
+	filtered := []types.Container{}
+	for _, container := range containers {
+		if hasLabels(container.Labels, labels) {
+			filtered = append(filtered, container)
+		}
+	}
+	return filtered, nil
+}
+
+// CopyFromContainer requests the archive directly, since podman doesn't send the path stat header
+// which the docker client insists on. Podman doesn't understand the "dir/." notation either.
+func (p *Podman) CopyFromContainer(ctx context.Context, id, srcPath string) (io.ReadCloser, error) {
+	query := url.Values{}
+	query.Set("path", strings.TrimSuffix(srcPath, "/."))
+	requestURL := fmt.Sprintf("http://podman/v%s/containers/%s/archive?%s", p.client.ClientVersion(), id, query.Encode())
+	request, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := p.client.HTTPClient().Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("podman couldn't copy %s from container [%s] (status code %d)", srcPath, id, response.StatusCode)
+	}
+	return response.Body, nil
+}
+
+// CreateNetwork always uses the bridge driver, since podman doesn't fall back to it if no driver is given
+func (p *Podman) CreateNetwork(ctx context.Context, name string, options types.NetworkCreate) (string, error) {
+	if options.Driver == "" {
+		options.Driver = "bridge"
+	}
+	return p.Docker.CreateNetwork(ctx, name, options)
+}
+
+// ListNetworks filters the networks by label on the client side, since podman doesn't combine multiple label filters
+func (p *Podman) ListNetworks(ctx context.Context, labels map[string]string) ([]types.NetworkResource, error) {
+	networks, err := p.client.NetworkList(ctx, types.NetworkListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	filtered := []types.NetworkResource{}
+	for _, network := range networks {
+		if hasLabels(network.Labels, labels) {
+			filtered = append(filtered, network)
+		}
+	}
+	return filtered, nil
+}
+
+// ListVolumes filters the volumes by label on the client side, since podman doesn't combine multiple label filters
+func (p *Podman) ListVolumes(ctx context.Context, labels map[string]string) ([]*types.Volume, error) {
+	volumes, err := p.Docker.ListVolumes(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	filtered := []*types.Volume{}
+	for _, volume := range volumes {
+		if hasLabels(volume.Labels, labels) {
+			filtered = append(filtered, volume)
+		}
+	}
+	return filtered, nil
+}
+
+func (p *Podman) SocketPath() string {
+	return p.socket
+}
+
+var _ Runtime = &Podman{}
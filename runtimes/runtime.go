@@ -0,0 +1,100 @@
+package runtimes
+
+/*
+ * The Runtime interface abstracts the container runtime that k3d runs the cluster nodes in.
+ * It is created once and passed to all functions of the cluster package, so that they can be tested
+ * against the in-memory Fake runtime instead of a docker daemon.
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+)
+
+// Runtime describes the container, network, volume, exec, logs and image operations that k3d needs
+type Runtime interface {
+	// CreateContainer creates (but doesn't start) a container and returns its ID.
+	// It returns a not found error (see IsErrNotFound), if the image isn't available locally.
+	CreateContainer(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (string, error)
+	StartContainer(ctx context.Context, id string) error
+	StopContainer(ctx context.Context, id string) error
+	// RemoveContainer force-removes a container together with its anonymous volumes
+	RemoveContainer(ctx context.Context, id string) error
+	InspectContainer(ctx context.Context, id string) (types.ContainerJSON, error)
+	// ListContainers returns the containers which have all of the given labels (including stopped ones, if all is set)
+	ListContainers(ctx context.Context, labels map[string]string, all bool) ([]types.Container, error)
+	// ContainerLogs returns the combined stdout and stderr of a container
+	ContainerLogs(ctx context.Context, id string) (io.ReadCloser, error)
+	// Exec runs a command in a running container and returns its combined output and exit code
+	Exec(ctx context.Context, id string, cmd []string) (string, int, error)
+	// CopyFromContainer returns a tar archive of a file or directory in the container
+	CopyFromContainer(ctx context.Context, id, srcPath string) (io.ReadCloser, error)
+
+	CreateNetwork(ctx context.Context, name string, options types.NetworkCreate) (string, error)
+	// ListNetworks returns the networks which have all of the given labels
+	ListNetworks(ctx context.Context, labels map[string]string) ([]types.NetworkResource, error)
+	RemoveNetwork(ctx context.Context, id string) error
+	// ConnectNetwork connects an existing container to another network, in which it's reachable by the given aliases
+	ConnectNetwork(ctx context.Context, networkID, containerID string, aliases []string) error
+
+	CreateVolume(ctx context.Context, options volume.VolumeCreateBody) (types.Volume, error)
+	// ListVolumes returns the volumes which have all of the given labels
+	ListVolumes(ctx context.Context, labels map[string]string) ([]*types.Volume, error)
+	// RemoveVolume force-removes a volume
+	RemoveVolume(ctx context.Context, name string) error
+
+	// ImageExists checks whether the image is available locally (without pulling it)
+	ImageExists(ctx context.Context, image string) (bool, error)
+	// ImageID returns the ID of the local image (which changes whenever the image is rebuilt or pulled again).
+	// It returns a not found error (see IsErrNotFound), if the image isn't available locally.
+	ImageID(ctx context.Context, image string) (string, error)
+	// PullImage pulls an image and writes the progress to output
+	PullImage(ctx context.Context, image string, output io.Writer) error
+	// LoadImage loads an image tarball into the runtime's image store and writes the progress to output
+	LoadImage(ctx context.Context, input io.Reader, output io.Writer) error
+
+	// Ping checks whether the runtime is responding
+	Ping(ctx context.Context) (types.Ping, error)
+	// Info returns information about the runtime's host, e.g. its number of CPUs and total memory
+	Info(ctx context.Context) (types.Info, error)
+	// SocketPath returns the path of the runtime's Docker-compatible API socket on the host (mounted into the k3d tools container)
+	SocketPath() string
+	// SupportsRestartPolicy reports whether the runtime restarts containers according to their restart policy
+	SupportsRestartPolicy() bool
+}
+
+// ErrUnavailable means that the runtime (e.g. the docker daemon) can't be reached
+var ErrUnavailable = errors.New("container runtime is not available")
+
+// New creates the runtime with the given name (docker or podman). Without a name, podman is used
+// if its API socket exists but docker's doesn't (and DOCKER_HOST isn't set), otherwise docker.
+func New(name string) (Runtime, error) {
+	if name == "" {
+		name = "docker"
+		if _, err := os.Stat(defaultDockerSocket); os.IsNotExist(err) && os.Getenv("DOCKER_HOST") == "" && findPodmanSocket() != "" {
+			name = "podman"
+		}
+	}
+
+	switch name {
+	case "docker":
+		return NewDocker()
+	case "podman":
+		return NewPodman()
+	}
+	return nil, fmt.Errorf("unknown runtime %s (supported: docker, podman)", name)
+}
+
+// IsErrNotFound checks whether an error returned by a Runtime means that the requested object (e.g. an image) doesn't exist
+func IsErrNotFound(err error) bool {
+	return client.IsErrNotFound(err)
+}